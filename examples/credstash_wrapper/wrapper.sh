@@ -15,4 +15,4 @@ fi
 	${SMUGGLER_credstash_table:+-t ${SMUGGLER_credstash_table}} \
 	exec "${SCRIPT_PATH}"/spruce merge | \
 		"${SCRIPT_PATH}"/spruce json | \
-		/opt/resource/"${SMUGGLER_COMMAND}.wrapped" $@
+		/opt/resource/wrapped/"${SMUGGLER_wrapped}"/"${SMUGGLER_COMMAND}" $@
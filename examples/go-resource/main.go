@@ -0,0 +1,45 @@
+// A resource implemented in Go with the smuggler library, which writes the
+// current time in a file. Build it and install it as
+// /opt/resource/{check,in,out}.
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+type timeResource struct{}
+
+func (timeResource) Check(ctx context.Context, request *smuggler.ResourceRequest) ([]smuggler.Version, error) {
+	interval := time.Hour
+	params, err := request.AllParams()
+	if err != nil {
+		return nil, err
+	}
+	if i, ok := params["interval"].(string); ok {
+		if interval, err = time.ParseDuration(i); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now().Truncate(interval).UTC().Format(time.RFC3339)
+	smuggler.ContextLogger(ctx).Printf("[INFO] Current time %s", now)
+	return []smuggler.Version{{"time": now}}, nil
+}
+
+func (timeResource) In(ctx context.Context, destinationDir string, request *smuggler.ResourceRequest) (smuggler.Version, []smuggler.MetadataPair, error) {
+	err := ioutil.WriteFile(filepath.Join(destinationDir, "time"), []byte(request.Version["time"]), 0644)
+	return request.Version, nil, err
+}
+
+func (timeResource) Out(ctx context.Context, sourcesDir string, request *smuggler.ResourceRequest) (smuggler.Version, []smuggler.MetadataPair, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	return smuggler.Version{"time": now}, nil, nil
+}
+
+func main() {
+	smuggler.Serve(timeResource{})
+}
@@ -0,0 +1,136 @@
+package smuggler
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Directory of the check cache if none is given
+var DefaultCheckCacheDir = filepath.Join(os.TempDir(), "smuggler-check-cache")
+
+// Caches the response of check for the same source and version
+type CheckCacheDefinition struct {
+	TTL string `json:"ttl"`
+	Dir string `json:"dir,omitempty"`
+}
+
+func (c CheckCacheDefinition) Directory() string {
+	if c.Dir != "" {
+		return c.Dir
+	}
+	return DefaultCheckCacheDir
+}
+
+// Response of check as stored in the cache
+type cachedCheck struct {
+	Created  time.Time `json:"created"`
+	Versions []Version `json:"versions"`
+}
+
+// Entry of the check cache, locked while it is open so concurrent checks
+// with the same source and version run the command only once
+type checkCache struct {
+	path string
+	ttl  time.Duration
+	lock *os.File
+}
+
+// Opens the cache entry of the request, waiting for any other check
+// holding it
+func openCheckCache(request *ResourceRequest) (*checkCache, error) {
+	definition := request.Source.CheckCache
+	ttl, err := time.ParseDuration(definition.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check_cache.ttl '%s': %s", definition.TTL, err)
+	}
+	key, err := checkCacheKey(request)
+	if err != nil {
+		return nil, err
+	}
+	dir := definition.Directory()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, key)
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("locking '%s': %s", lock.Name(), err)
+	}
+	return &checkCache{path: path + ".json", ttl: ttl, lock: lock}, nil
+}
+
+// The key is the hash of the source merged with smuggler.yml and the
+// version, as the commands, their params and environment are part of the
+// source and change the response of check
+func checkCacheKey(request *ResourceRequest) (string, error) {
+	b, err := json.Marshal(struct {
+		Source  map[string]interface{} `json:"source"`
+		Version Version                `json:"version"`
+	}{request.OrigRequest.Source, request.Version})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b)), nil
+}
+
+// Returns the cached versions, if they did not expire
+func (cache *checkCache) Get() ([]Version, bool) {
+	var cached cachedCheck
+	if err := readJsonFile(cache.path, &cached); err != nil {
+		return nil, false
+	}
+	if time.Since(cached.Created) > cache.ttl {
+		return nil, false
+	}
+	return cached.Versions, true
+}
+
+func (cache *checkCache) Put(versions []Version) error {
+	b, err := json.Marshal(cachedCheck{Created: time.Now().UTC(), Versions: versions})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(cache.path, b, 0600)
+}
+
+// Releases the lock of the entry
+func (cache *checkCache) Close() error {
+	syscall.Flock(int(cache.lock.Fd()), syscall.LOCK_UN)
+	return cache.lock.Close()
+}
+
+// Runs check, or returns the response in the cache if it did not expire.
+// The response is only cached if check succeeds.
+func (command *SmugglerCommand) runCachedCheck(dataDir string, request *ResourceRequest) (*ResourceResponse, error) {
+	cache, err := openCheckCache(request)
+	if err != nil {
+		command.logger.Printf("[WARN] Cannot use the check cache: %s", err)
+		return command.runAction(dataDir, request)
+	}
+	defer cache.Close()
+
+	if versions, ok := cache.Get(); ok {
+		command.logger.Printf("[INFO] Check cache hit in '%s', not running check", cache.path)
+		command.logger.Printf("[INFO] cache reports versions '%q'", versions)
+		return &ResourceResponse{Type: request.Type, Versions: versions}, nil
+	}
+	command.logger.Printf("[INFO] Check cache miss in '%s'", cache.path)
+
+	response, err := command.runAction(dataDir, request)
+	if err != nil {
+		return response, err
+	}
+	if err := cache.Put(response.Versions); err != nil {
+		command.logger.Printf("[WARN] Cannot write the check cache '%s': %s", cache.path, err)
+	}
+	return response, nil
+}
@@ -0,0 +1,243 @@
+package smuggler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+)
+
+// Key of the smuggler configuration files with other files to include,
+// relative to the file
+const IncludeKey = "include"
+
+// Key of the smuggler configuration with the profiles by name, each one
+// with configuration to merge over the rest when selected with `profile`
+const ProfilesKey = "profiles"
+
+// Directory with the fragments of configuration, next to smuggler.yml
+const ConfigDirName = "smuggler.d"
+
+// Smuggler configuration, merged from all its files
+type SmugglerConfig struct {
+	Values     map[string]interface{}
+	Strategies map[string]MergeStrategy
+	// File of each value
+	Origins ConfigOrigins
+}
+
+// Returns the files of configuration, in the order they are merged:
+//
+//   - smuggler.yml in the directory of the binary or, if there is none,
+//     the files in the colon separated list SMUGGLER_CONFIG, by default
+//     /opt/resource/smuggler.yml.
+//   - The files smuggler.d/*.yml in the directory of the binary or, if
+//     there is none, in /opt/resource, in lexical order.
+//
+// The files which do not exist are skipped.
+func FindSmugglerConfigPaths(logger *log.Logger) []string {
+	binaryDir := filepath.Dir(os.Args[0])
+	candidates := []string{filepath.Join(binaryDir, "smuggler.yml")}
+	if !fileExists(candidates[0]) {
+		candidates = filepath.SplitList(utils.GetEnvOrDefault("SMUGGLER_CONFIG", "/opt/resource/smuggler.yml"))
+	}
+	paths := []string{}
+	for _, f := range candidates {
+		if fileExists(f) {
+			paths = append(paths, f)
+		} else {
+			logger.Printf("[INFO] No config file '%s'", f)
+		}
+	}
+
+	for _, dir := range []string{filepath.Join(binaryDir, ConfigDirName), filepath.Join("/opt/resource", ConfigDirName)} {
+		if !fileExists(dir) {
+			continue
+		}
+		fragments, _ := filepath.Glob(filepath.Join(dir, "*.yml"))
+		sort.Strings(fragments)
+		paths = append(paths, fragments...)
+		break
+	}
+	return paths
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Reads and merges the files of configuration in order, each one with the
+// files it includes merged before it
+func ReadSmugglerConfig(paths []string) (*SmugglerConfig, error) {
+	loader := configLoader{loaded: map[string]bool{}}
+	for _, p := range paths {
+		if err := loader.load(p, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// The strategies apply to all the files
+	config := &SmugglerConfig{
+		Values:     map[string]interface{}{},
+		Strategies: map[string]MergeStrategy{},
+		Origins:    ConfigOrigins{},
+	}
+	for _, f := range loader.files {
+		for p, strategy := range f.strategies {
+			config.Strategies[p] = strategy
+		}
+	}
+	for _, f := range loader.files {
+		values, err := mergeConfig(config.Values, f.values, f.path, config.Strategies, config.Origins)
+		if err != nil {
+			return nil, err
+		}
+		config.Values = values
+	}
+	return config, nil
+}
+
+// Returns the configuration without the profiles, with the given profile
+// merged over it if any
+func (config *SmugglerConfig) WithProfile(name string) (*SmugglerConfig, error) {
+	profiles, _ := config.Values[ProfilesKey].(map[string]interface{})
+	result := &SmugglerConfig{
+		Values:     copyMaps(config.Values),
+		Strategies: config.Strategies,
+		Origins:    config.Origins.copy(),
+	}
+	delete(result.Values, ProfilesKey)
+	result.Origins.forget(ProfilesKey)
+	if name == "" {
+		return result, nil
+	}
+
+	profile, ok := profiles[name].(map[string]interface{})
+	if !ok {
+		names := sortedKeys(profiles)
+		if len(names) == 0 {
+			return nil, fmt.Errorf("unknown profile '%s', there are no profiles", name)
+		}
+		return nil, fmt.Errorf("unknown profile '%s', must be one of: %s", name, strings.Join(names, ", "))
+	}
+	var err error
+	result.Values, err = mergeConfig(result.Values, profile, fmt.Sprintf("profile '%s'", name), config.Strategies, result.Origins)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Parses the content of a configuration file, without includes
+func ParseSmugglerConfig(content []byte, origin string) (*SmugglerConfig, error) {
+	f, err := parseConfigFile(content, origin)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := f.values[IncludeKey]; ok {
+		return nil, fmt.Errorf("'%s': '%s' is only supported in files", origin, IncludeKey)
+	}
+	config := &SmugglerConfig{Strategies: f.strategies, Origins: ConfigOrigins{}}
+	config.Values, err = mergeConfig(nil, f.values, origin, f.strategies, config.Origins)
+	return config, err
+}
+
+type configFile struct {
+	path       string
+	values     map[string]interface{}
+	strategies map[string]MergeStrategy
+	includes   []string
+}
+
+func parseConfigFile(content []byte, path string) (*configFile, error) {
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("parsing '%s': %s", path, err)
+	}
+	if err := ValidateConfig(values); err != nil {
+		return nil, fmt.Errorf("in '%s': %s", path, err)
+	}
+
+	f := &configFile{path: path, values: values, strategies: map[string]MergeStrategy{}}
+	if m, ok := values[MergeStrategiesKey].(map[string]interface{}); ok {
+		for p, strategy := range m {
+			f.strategies[p] = MergeStrategy(strategy.(string))
+		}
+	}
+	switch include := values[IncludeKey].(type) {
+	case string:
+		f.includes = []string{include}
+	case []interface{}:
+		for _, i := range include {
+			f.includes = append(f.includes, i.(string))
+		}
+	}
+	delete(values, MergeStrategiesKey)
+	delete(values, IncludeKey)
+	return f, nil
+}
+
+// Loads the files of configuration with their includes, in merge order
+type configLoader struct {
+	files  []*configFile
+	loaded map[string]bool
+}
+
+// Loads the file after the files it includes. The chain of files including
+// it is given to detect cycles.
+func (loader *configLoader) load(path string, chain []string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, p := range chain {
+		if p == absPath {
+			return fmt.Errorf("include cycle: %s -> %s", strings.Join(chain, " -> "), absPath)
+		}
+	}
+	// Already loaded from another file
+	if loader.loaded[absPath] {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading '%s': %s", path, err)
+	}
+	f, err := parseConfigFile(content, path)
+	if err != nil {
+		return err
+	}
+
+	chain = append(chain, absPath)
+	for _, include := range f.includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		matches, err := filepath.Glob(include)
+		if err != nil {
+			return fmt.Errorf("in '%s': invalid include '%s': %s", path, include, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(include, "*?[") {
+			return fmt.Errorf("in '%s': included file '%s' does not exist", path, include)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if err := loader.load(m, chain); err != nil {
+				return err
+			}
+		}
+	}
+
+	loader.loaded[absPath] = true
+	loader.files = append(loader.files, f)
+	return nil
+}
@@ -0,0 +1,145 @@
+package smuggler_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var _ = Describe("ReadSmugglerConfig", func() {
+	var configDir string
+
+	BeforeEach(func() {
+		configDir, err = ioutil.TempDir("", "smuggler-config")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(configDir)
+	})
+
+	writeConfig := func(name string, content string) string {
+		path := filepath.Join(configDir, name)
+		Ω(os.MkdirAll(filepath.Dir(path), 0755)).Should(Succeed())
+		Ω(ioutil.WriteFile(path, []byte(content), 0644)).Should(Succeed())
+		return path
+	}
+
+	It("merges the files in order, each one after its includes", func() {
+		base := writeConfig("smuggler.yml", `
+include: [ "common/*.yml" ]
+merge_strategies:
+  smuggler_params.tags: append
+smuggler_params:
+  region: from-base
+  tags: [ base ]
+`)
+		writeConfig("common/a.yml", "smuggler_params: { region: from-a, tags: [ a ], a: 1 }\n")
+		writeConfig("common/b.yml", "smuggler_params: { b: 2 }\ntimeout: 1m\n")
+		flavour := writeConfig("smuggler.d/10-flavour.yml", "smuggler_params: { tags: [ flavour ] }\ntimeout: 2m\n")
+
+		config, err := ReadSmugglerConfig([]string{base, flavour})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(config.Values).Should(Equal(map[string]interface{}{
+			"smuggler_params": map[string]interface{}{
+				"region": "from-base",
+				"tags":   []interface{}{"a", "base", "flavour"},
+				"a":      1.0,
+				"b":      2.0,
+			},
+			"timeout": "2m",
+		}))
+		Ω(config.Origins["smuggler_params.region"]).Should(Equal(base))
+		Ω(config.Origins["smuggler_params.b"]).Should(Equal(filepath.Join(configDir, "common/b.yml")))
+		Ω(config.Origins["timeout"]).Should(Equal(flavour))
+		Ω(config.Origins["smuggler_params.tags"]).Should(Equal(
+			filepath.Join(configDir, "common/a.yml") + "+" + base + "+" + flavour,
+		))
+	})
+
+	It("fails if the files include each other", func() {
+		a := writeConfig("a.yml", "include: b.yml\n")
+		writeConfig("b.yml", "include: [ c.yml ]\n")
+		writeConfig("c.yml", "include: a.yml\n")
+
+		_, err := ReadSmugglerConfig([]string{a})
+		Ω(err).Should(MatchError(ContainSubstring("include cycle: ")))
+		Ω(err).Should(MatchError(HaveSuffix("c.yml -> " + a)))
+	})
+
+	It("fails if an included file does not exist", func() {
+		a := writeConfig("a.yml", "include: missing.yml\n")
+		_, err := ReadSmugglerConfig([]string{a})
+		Ω(err).Should(MatchError(ContainSubstring("included file '" + filepath.Join(configDir, "missing.yml") + "' does not exist")))
+	})
+
+	It("reports the file with invalid configuration", func() {
+		a := writeConfig("a.yml", "include: b.yml\n")
+		b := writeConfig("b.yml", "timeout: never\n")
+		_, err := ReadSmugglerConfig([]string{a})
+		Ω(err).Should(MatchError(ContainSubstring("in '" + b + "': invalid configuration")))
+	})
+})
+
+var _ = Describe("ParseInputAndConfig with profiles", func() {
+	var smugglerConfig *SmugglerConfig
+
+	BeforeEach(func() {
+		smugglerConfig, err = ParseSmugglerConfig([]byte(`
+profile: git
+timeout: 1m
+commands:
+  check: echo default
+smuggler_params:
+  wrapped: none
+  region: eu-west-1
+profiles:
+  git:
+    commands:
+      check: echo git
+    smuggler_params: { wrapped: git }
+  s3:
+    timeout: 2m
+    smuggler_params: { wrapped: s3 }
+`), "smuggler.yml")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	It("merges the profile selected in the pipeline", func() {
+		request = ParseInputAndConfig(CheckType, []byte(`{"source": {"profile": "s3"}}`), smugglerConfig)
+		Ω(request.Source.Timeout).Should(Equal("2m"))
+		Ω(request.Source.Commands["check"]).Should(Equal("echo default"))
+		Ω(request.Source.SmugglerParams).Should(Equal(map[string]interface{}{
+			"wrapped": "s3",
+			"region":  "eu-west-1",
+		}))
+		Ω(request.ConfigOrigins["smuggler_params.wrapped"]).Should(Equal("profile 's3'"))
+		Ω(request.ConfigOrigins["smuggler_params.region"]).Should(Equal("smuggler.yml"))
+	})
+
+	It("merges the default profile of smuggler.yml", func() {
+		request = ParseInputAndConfig(CheckType, []byte(`{"source": {}}`), smugglerConfig)
+		Ω(request.Source.Profile).Should(Equal("git"))
+		Ω(request.Source.Timeout).Should(Equal("1m"))
+		Ω(request.Source.Commands["check"]).Should(Equal("echo git"))
+		Ω(request.Source.SmugglerParams["wrapped"]).Should(Equal("git"))
+	})
+
+	It("does not pass the profiles to the commands", func() {
+		request = ParseInputAndConfig(CheckType, []byte(`{"source": {"profile": "s3", "bucket": "b"}}`), smugglerConfig)
+		Ω(request.Source.ExtraParams).Should(Equal(map[string]interface{}{"bucket": "b"}))
+		Ω(request.FilteredRequest.Source).Should(Equal(map[string]interface{}{"bucket": "b"}))
+		for path := range request.ConfigOrigins {
+			Ω(path).ShouldNot(HavePrefix(ProfilesKey))
+		}
+	})
+
+	It("fails with an unknown profile", func() {
+		smugglerConfig, err = smugglerConfig.WithProfile("svn")
+		Ω(err).Should(MatchError("unknown profile 'svn', must be one of: git, s3"))
+	})
+})
@@ -0,0 +1,250 @@
+package smuggler
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Environment in which a command runs. By default, commands run in the
+// working directory, as the user and with the environment of smuggler.
+type CommandEnvironment struct {
+	// Working directory of the command
+	Dir string `json:"dir,omitempty"`
+	// Name or uid of the user to run the command as. Its primary group is
+	// used unless gid is given.
+	User string `json:"user,omitempty"`
+	Uid  *int   `json:"uid,omitempty"`
+	Gid  *int   `json:"gid,omitempty"`
+	// Octal file mode creation mask, like "022"
+	Umask string `json:"umask,omitempty"`
+	// Variables to set, overriding the inherited ones
+	Env map[string]string `json:"env,omitempty"`
+	// Only the variables of smuggler matching these names or patterns, like
+	// `AWS_*`, are passed to the command
+	EnvPassthrough []string `json:"env_passthrough,omitempty"`
+	// Do not pass the environment of smuggler, but the env_passthrough ones
+	ClearEnv bool `json:"clear_env,omitempty"`
+}
+
+// Returns the environment of the command, with the params by variable
+// name, the inherited variables, the ones of the user and the static ones
+func (e CommandEnvironment) environment(params map[string]interface{}, userEnv []string) []string {
+	env := make([]string, 0, len(params))
+	for k, v := range params {
+		env = append(env, fmt.Sprintf("%s=%s", k, InterfaceToJsonString(v)))
+	}
+	for _, kv := range os.Environ() {
+		if e.passesThrough(strings.SplitN(kv, "=", 2)[0]) {
+			env = append(env, kv)
+		}
+	}
+	env = append(env, userEnv...)
+	for _, k := range sortedStringKeys(e.Env) {
+		env = append(env, fmt.Sprintf("%s=%s", k, e.Env[k]))
+	}
+	return env
+}
+
+// If the variable of smuggler with the given name is passed to the command
+func (e CommandEnvironment) passesThrough(name string) bool {
+	if !e.ClearEnv && len(e.EnvPassthrough) == 0 {
+		return true
+	}
+	for _, pattern := range e.EnvPassthrough {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the credential to run the command as, or nil to run it as the
+// current user. Also returns the home and name of the user if it is given.
+func (e CommandEnvironment) credential() (*syscall.Credential, []string, error) {
+	if e.User == "" && e.Uid == nil && e.Gid == nil {
+		return nil, nil, nil
+	}
+	credential := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+		// Do not keep the supplementary groups of smuggler
+		Groups: []uint32{},
+	}
+	var env []string
+	if e.User != "" {
+		u, err := lookupUser(e.User)
+		if err != nil {
+			return nil, nil, err
+		}
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		credential.Uid, credential.Gid = uint32(uid), uint32(gid)
+		env = []string{"HOME=" + u.HomeDir, "USER=" + u.Username}
+	}
+	if e.Uid != nil {
+		credential.Uid = uint32(*e.Uid)
+	}
+	if e.Gid != nil {
+		credential.Gid = uint32(*e.Gid)
+	}
+	return credential, env, nil
+}
+
+// The command must be able to write its response in the output dir and
+// the destination dir of in, and to read the response file of the post
+// hooks, when it runs as another user
+func chownCommandFiles(params map[string]interface{}, credential *syscall.Credential) error {
+	if credential == nil {
+		return nil
+	}
+	for _, k := range []string{"OUTPUT_DIR", "DESTINATION_DIR", "RESPONSE_FILE"} {
+		p, ok := params[smugglerVariable(k)].(string)
+		if !ok || p == "" {
+			continue
+		}
+		if err := os.Chown(p, int(credential.Uid), int(credential.Gid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err == nil {
+		return u, nil
+	}
+	if _, convErr := strconv.Atoi(name); convErr == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid user '%s': %s", name, err)
+}
+
+// Returns the umask of the command, or -1 to keep the one of smuggler
+func (e CommandEnvironment) umask() (int, error) {
+	if e.Umask == "" {
+		return -1, nil
+	}
+	return parseUmask(e.Umask)
+}
+
+func parseUmask(s string) (int, error) {
+	umask, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || umask > 0777 {
+		return 0, fmt.Errorf("invalid umask '%s', expected octal mode like '022'", s)
+	}
+	return int(umask), nil
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Prefix of the variables set by smuggler, and of the params by default
+const SmugglerEnvPrefix = "SMUGGLER_"
+
+// Case of the names of the params in the environment
+type EnvCase string
+
+const (
+	EnvCasePreserve EnvCase = "preserve"
+	EnvCaseUpper    EnvCase = "upper"
+	EnvCaseLower    EnvCase = "lower"
+)
+
+func NewEnvCase(s string) (EnvCase, error) {
+	switch c := EnvCase(s); c {
+	case "":
+		return EnvCasePreserve, nil
+	case EnvCasePreserve, EnvCaseUpper, EnvCaseLower:
+		return c, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid env_case '%s', must be one of: %s, %s, %s",
+			s, EnvCasePreserve, EnvCaseUpper, EnvCaseLower,
+		)
+	}
+}
+
+// Name of a variable set by smuggler, like SMUGGLER_OUTPUT_DIR
+func smugglerVariable(name string) string {
+	return SmugglerEnvPrefix + name
+}
+
+// Returns the params by the name of their variable in the environment:
+// the env_prefix and the name in the env_case, with the invalid characters
+// replaced by `_`. With env_flatten, the nested maps are exported as a
+// variable for each value, with the keys joined by `_`.
+func (source SmugglerSource) paramsEnv(params map[string]interface{}) (map[string]interface{}, error) {
+	prefix := SmugglerEnvPrefix
+	if source.EnvPrefix != nil {
+		prefix = *source.EnvPrefix
+	}
+	envCase, err := NewEnvCase(source.EnvCase)
+	if err != nil {
+		return nil, err
+	}
+
+	env := map[string]interface{}{}
+	// Param of each variable, to report the collisions
+	origins := map[string]string{}
+	var add func(key string, v interface{}) error
+	add = func(key string, v interface{}) error {
+		if m, ok := v.(map[string]interface{}); ok && source.EnvFlatten {
+			for _, k := range sortedKeys(m) {
+				if err := add(key+"_"+k, m[k]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		switch envCase {
+		case EnvCaseUpper:
+			key = strings.ToUpper(key)
+		case EnvCaseLower:
+			key = strings.ToLower(key)
+		}
+		name := sanitizeEnvName(prefix + key)
+		if origin, ok := origins[name]; ok {
+			return fmt.Errorf("params '%s' and '%s' are both exported as '%s'", origin, key, name)
+		}
+		origins[name] = key
+		env[name] = v
+		return nil
+	}
+	for _, k := range sortedKeys(params) {
+		if err := add(k, params[k]); err != nil {
+			return nil, err
+		}
+	}
+	return env, nil
+}
+
+// Replaces the characters which are not valid in a variable name by `_`,
+// and prepends `_` if it starts by a digit
+func sanitizeEnvName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
@@ -0,0 +1,5 @@
+package smuggler
+
+// Unexported functions used by the tests
+var SignS3Request = signS3Request
+var S3EscapePath = s3EscapePath
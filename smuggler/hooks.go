@@ -0,0 +1,173 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+type HookType string
+
+const (
+	// Runs before the command of the action
+	PreHook HookType = "pre"
+	// Runs after the command of the action succeeds
+	PostHook HookType = "post"
+	// Runs when the action fails, including a failed pre or post hook
+	OnFailureHook HookType = "on_failure"
+)
+
+var hookTypes = []string{string(PreHook), string(PostHook), string(OnFailureHook)}
+
+// Returns the hooks of the given type for the action. The global pre
+// hook runs before the one of the action, and the global post and
+// on_failure hooks after the ones of the action.
+func (source SmugglerSource) FindHooks(action RequestType, hookType HookType) ([]*CommandDefinition, error) {
+	var global, perAction interface{}
+	global = source.Hooks[string(hookType)]
+	if actionHooks, ok := source.Hooks[string(action)].(map[string]interface{}); ok {
+		perAction = actionHooks[string(hookType)]
+	}
+
+	cmds := []interface{}{global, perAction}
+	if hookType != PreHook {
+		cmds = []interface{}{perAction, global}
+	}
+
+	hooks := []*CommandDefinition{}
+	for _, cmd := range cmds {
+		if cmd == nil {
+			continue
+		}
+		c, err := source.newCommandDefinition(fmt.Sprintf("%s %s hook", action, hookType), cmd)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, c)
+	}
+	return hooks, nil
+}
+
+// State of the last command run, to report the command of the action
+// and not the hooks run after it
+type commandState struct {
+	lastCommand *exec.Cmd
+	env         []string
+	timedOut    bool
+	ranScript   bool
+	scriptErr   error
+	output      []byte
+	err         []byte
+}
+
+func (command *SmugglerCommand) saveState() commandState {
+	return commandState{
+		lastCommand: command.lastCommand,
+		env:         command.lastEnv,
+		timedOut:    command.timedOut,
+		ranScript:   command.ranScript,
+		scriptErr:   command.scriptErr,
+		output:      command.LastCommandOutput,
+		err:         command.LastCommandErr,
+	}
+}
+
+func (command *SmugglerCommand) restoreState(state commandState) {
+	command.lastCommand = state.lastCommand
+	command.lastEnv = state.env
+	command.timedOut = state.timedOut
+	command.ranScript = state.ranScript
+	command.scriptErr = state.scriptErr
+	command.LastCommandOutput = state.output
+	command.LastCommandErr = state.err
+}
+
+// Runs the hooks of the given type with the same environment as the
+// command, plus the given extra params. If a hook fails, its state is
+// kept so the exit status of the hook is reported.
+func (command *SmugglerCommand) runHooks(hookType HookType, dataDir string, request *ResourceRequest, extraParams map[string]interface{}) error {
+	hooks, err := request.Source.FindHooks(request.Type, hookType)
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+
+	outputDir, err := ioutil.TempDir("", "smuggler-hook")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outputDir)
+
+	params, err := prepareParams(dataDir, outputDir, request)
+	if err != nil {
+		return err
+	}
+	params[smugglerVariable("HOOK")] = string(hookType)
+	for k, v := range extraParams {
+		params[smugglerVariable(k)] = v
+	}
+
+	jsonRequest, err := prepareJsonRequest(request)
+	if err != nil {
+		return err
+	}
+
+	state := command.saveState()
+	for _, hook := range hooks {
+		command.logger.Printf("[INFO] Running %s hook", hookType)
+		if err := command.Run(*hook, params, jsonRequest); err != nil {
+			return fmt.Errorf("%s hook failed: %s", hookType, err)
+		}
+	}
+	command.restoreState(state)
+	return nil
+}
+
+// Runs the post hooks, which can read the response of the action from
+// the file in SMUGGLER_RESPONSE_FILE
+func (command *SmugglerCommand) runPostHooks(dataDir string, request *ResourceRequest, response *ResourceResponse) error {
+	if hooks, err := request.Source.FindHooks(request.Type, PostHook); err != nil || len(hooks) == 0 {
+		return err
+	}
+
+	responseFile, err := ioutil.TempFile("", "smuggler-response")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(responseFile.Name())
+
+	var jsonResponse []byte
+	if response.Type == CheckType {
+		jsonResponse, err = json.Marshal(response.Versions)
+	} else {
+		jsonResponse, err = json.Marshal(response)
+	}
+	if err == nil {
+		_, err = responseFile.Write(jsonResponse)
+	}
+	responseFile.Close()
+	if err != nil {
+		return err
+	}
+
+	return command.runHooks(PostHook, dataDir, request, map[string]interface{}{
+		"RESPONSE_FILE": responseFile.Name(),
+	})
+}
+
+// Runs the on_failure hooks, with the exit status and the error of the
+// action in SMUGGLER_EXIT_STATUS and SMUGGLER_ERROR. The failure of the
+// action is reported, even if these hooks fail.
+func (command *SmugglerCommand) runFailureHooks(dataDir string, request *ResourceRequest, actionErr error) {
+	state := command.saveState()
+	defer command.restoreState(state)
+
+	err := command.runHooks(OnFailureHook, dataDir, request, map[string]interface{}{
+		"EXIT_STATUS": command.LastCommandExitStatus(),
+		"ERROR":       actionErr.Error(),
+	})
+	if err != nil {
+		command.logger.Printf("[WARN] %s", err)
+	}
+}
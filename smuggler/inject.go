@@ -0,0 +1,153 @@
+package smuggler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ghodss/yaml"
+)
+
+// Directory of the resource in the images, as defined by concourse
+const ResourceDir = "opt/resource"
+
+// Directory, relative to ResourceDir, where the original content of the
+// resource is moved when injecting smuggler
+const WrappedDir = "wrapped"
+
+// Default name of the wrapped resource, in `/opt/resource/wrapped/<name>`
+const DefaultWrappedName = "resource"
+
+type InjectOptions struct {
+	// Name of the wrapped resource, in `/opt/resource/wrapped/<name>`
+	Name string
+	// Content of the smuggler.yml to write in the resource
+	Config []byte
+	// Smuggler binary to inject
+	Binary []byte
+	// Path of the resulting OCI image layout tarball. By default, the
+	// given one is replaced.
+	Output string
+}
+
+// Reads and validates the smuggler.yml to inject
+func ReadInjectConfig(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("parsing '%s': %s", path, err)
+	}
+	if err := ValidateConfig(config); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Injects smuggler in the resource image in the given path, which can be
+// a rootfs directory, an OCI image layout directory or an OCI image
+// layout tarball.
+//
+// Smuggler is written as `/opt/resource/smuggler`, with `check`, `in` and
+// `out` as hardlinks to it, plus the given `smuggler.yml`. The existing
+// content of `/opt/resource` is moved to `/opt/resource/wrapped/<name>/`,
+// so the original commands can be called from the smuggler ones.
+func Inject(path string, options InjectOptions) error {
+	if options.Name == "" {
+		options.Name = DefaultWrappedName
+	}
+	if options.Name == "." || options.Name == ".." || filepath.Base(options.Name) != options.Name {
+		return fmt.Errorf("invalid name '%s'", options.Name)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return injectOciTarball(path, options)
+	}
+	if _, err := os.Stat(filepath.Join(path, "oci-layout")); err == nil {
+		return injectOciLayout(path, options)
+	}
+	return injectRootfs(path, options)
+}
+
+func injectRootfs(rootfs string, options InjectOptions) error {
+	resourceDir := filepath.Join(rootfs, ResourceDir)
+	if err := os.MkdirAll(resourceDir, 0755); err != nil {
+		return err
+	}
+
+	// Injected before, only update smuggler and its configuration
+	_, err := os.Stat(filepath.Join(resourceDir, "smuggler"))
+	if os.IsNotExist(err) {
+		if err := moveToWrappedDir(resourceDir, options.Name); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	smugglerPath := filepath.Join(resourceDir, "smuggler")
+	if err := writeFileAtomically(smugglerPath, options.Binary, 0755); err != nil {
+		return err
+	}
+	for _, name := range commandNames {
+		link := filepath.Join(resourceDir, name)
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Link(smugglerPath, link); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomically(filepath.Join(resourceDir, "smuggler.yml"), options.Config, 0644)
+}
+
+// Moves all the content of the resource directory to the wrapped one,
+// as the commands of most resources use other files next to them.
+func moveToWrappedDir(resourceDir string, name string) error {
+	entries, err := ioutil.ReadDir(resourceDir)
+	if err != nil {
+		return err
+	}
+	toMove := []string{}
+	for _, e := range entries {
+		if e.Name() != WrappedDir {
+			toMove = append(toMove, e.Name())
+		}
+	}
+	if len(toMove) == 0 {
+		return nil
+	}
+
+	wrappedDir := filepath.Join(resourceDir, WrappedDir, name)
+	if _, err := os.Stat(wrappedDir); err == nil {
+		return fmt.Errorf("'%s' already exists, use another name", filepath.Join("/", ResourceDir, WrappedDir, name))
+	}
+	if err := os.MkdirAll(wrappedDir, 0755); err != nil {
+		return err
+	}
+	for _, n := range toMove {
+		if err := os.Rename(filepath.Join(resourceDir, n), filepath.Join(wrappedDir, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileAtomically(path string, content []byte, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, mode); err != nil {
+		return err
+	}
+	// WriteFile does not change the mode of existing files
+	if err := os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
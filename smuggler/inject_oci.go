@@ -0,0 +1,531 @@
+package smuggler
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ociImageIndexMediaType      = "application/vnd.oci.image.index.v1+json"
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	ociLayerMediaType           = "application/vnd.oci.image.layer.v1.tar+gzip"
+	dockerLayerMediaType        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+var digestPattern = regexp.MustCompile(`^([a-z0-9]+):([a-f0-9]+)$`)
+
+// Injects smuggler in an OCI image layout tarball, extracting it,
+// injecting smuggler in the layout and archiving it again.
+func injectOciTarball(tarball string, options InjectOptions) error {
+	layoutDir, err := ioutil.TempDir("", "smuggler-inject")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layoutDir)
+
+	if err := extractTarball(tarball, layoutDir); err != nil {
+		return fmt.Errorf("extracting '%s': %s", tarball, err)
+	}
+	if _, err := os.Stat(filepath.Join(layoutDir, "oci-layout")); err != nil {
+		return fmt.Errorf("'%s' is not an OCI image layout tarball", tarball)
+	}
+	if err := injectOciLayout(layoutDir, options); err != nil {
+		return err
+	}
+
+	output := options.Output
+	if output == "" {
+		output = tarball
+	}
+	if err := createTarball(layoutDir, output+".tmp"); err != nil {
+		return err
+	}
+	return os.Rename(output+".tmp", output)
+}
+
+// Injects smuggler in all the images of an OCI image layout, adding a
+// layer to each one.
+func injectOciLayout(layoutDir string, options InjectOptions) error {
+	indexPath := filepath.Join(layoutDir, "index.json")
+	var index map[string]interface{}
+	if err := readJsonFile(indexPath, &index); err != nil {
+		return err
+	}
+	manifests, _ := index["manifests"].([]interface{})
+	if len(manifests) == 0 {
+		return fmt.Errorf("no images found in '%s'", indexPath)
+	}
+	for i, m := range manifests {
+		descriptor, ok := m.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid descriptor in '%s': %s", indexPath, InterfaceToJsonString(m))
+		}
+		switch descriptor["mediaType"] {
+		case ociImageIndexMediaType, dockerManifestListMediaType:
+			return fmt.Errorf("nested image indexes are not supported, found in '%s'", indexPath)
+		}
+		newDescriptor, err := injectOciManifest(layoutDir, descriptor, options)
+		if err != nil {
+			return err
+		}
+		manifests[i] = newDescriptor
+	}
+
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(indexPath, content, 0644)
+}
+
+// Adds a layer with smuggler to the image of the given manifest, and
+// returns the descriptor of the new manifest.
+func injectOciManifest(layoutDir string, descriptor map[string]interface{}, options InjectOptions) (map[string]interface{}, error) {
+	var manifest map[string]interface{}
+	if err := readJsonBlob(layoutDir, descriptor["digest"], &manifest); err != nil {
+		return nil, err
+	}
+	layers, _ := manifest["layers"].([]interface{})
+	configDescriptor, ok := manifest["config"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("manifest %s: missing config", descriptor["digest"])
+	}
+
+	files, err := readResourceDirFromLayers(layoutDir, layers)
+	if err != nil {
+		return nil, err
+	}
+	layer, err := buildInjectLayer(files, options)
+	if err != nil {
+		return nil, err
+	}
+	diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(layer))
+	compressedLayer := new(bytes.Buffer)
+	gz := gzip.NewWriter(compressedLayer)
+	if _, err := gz.Write(layer); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	layerDescriptor, err := writeBlob(layoutDir, compressedLayer.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	layerDescriptor["mediaType"] = ociLayerMediaType
+	if manifest["mediaType"] == dockerManifestMediaType {
+		layerDescriptor["mediaType"] = dockerLayerMediaType
+	}
+
+	var config map[string]interface{}
+	if err := readJsonBlob(layoutDir, configDescriptor["digest"], &config); err != nil {
+		return nil, err
+	}
+	rootfs, _ := config["rootfs"].(map[string]interface{})
+	if rootfs == nil {
+		return nil, fmt.Errorf("image config %s: missing rootfs", configDescriptor["digest"])
+	}
+	diffIDs, _ := rootfs["diff_ids"].([]interface{})
+	rootfs["diff_ids"] = append(diffIDs, diffID)
+	// The history must match the layers, so only add to an existing one
+	if history, ok := config["history"].([]interface{}); ok {
+		config["history"] = append(history, map[string]interface{}{
+			"created":    time.Now().UTC().Format(time.RFC3339),
+			"created_by": "smuggler inject",
+		})
+	}
+	newConfigDescriptor, err := writeJsonBlob(layoutDir, config)
+	if err != nil {
+		return nil, err
+	}
+	configDescriptor["digest"] = newConfigDescriptor["digest"]
+	configDescriptor["size"] = newConfigDescriptor["size"]
+
+	manifest["layers"] = append(layers, layerDescriptor)
+	newManifestDescriptor, err := writeJsonBlob(layoutDir, manifest)
+	if err != nil {
+		return nil, err
+	}
+	newDescriptor := copyMaps(descriptor)
+	newDescriptor["digest"] = newManifestDescriptor["digest"]
+	newDescriptor["size"] = newManifestDescriptor["size"]
+	return newDescriptor, nil
+}
+
+// A file from the layers of an image
+type layerFile struct {
+	header *tar.Header
+	data   []byte
+}
+
+// Returns the content of the resource directory resulting of applying
+// the given layers, by path without leading `/`.
+func readResourceDirFromLayers(layoutDir string, layers []interface{}) (map[string]*layerFile, error) {
+	files := map[string]*layerFile{}
+	for _, l := range layers {
+		descriptor, ok := l.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid layer descriptor: %s", InterfaceToJsonString(l))
+		}
+		blobPath, err := blobPath(layoutDir, descriptor["digest"])
+		if err != nil {
+			return nil, err
+		}
+		if err := readResourceDirFromLayer(blobPath, files); err != nil {
+			return nil, fmt.Errorf("reading layer %s: %s", descriptor["digest"], err)
+		}
+	}
+	return files, nil
+}
+
+func readResourceDirFromLayer(layerPath string, files map[string]*layerFile) error {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := maybeGzipReader(f)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanTarPath(header.Name)
+		dir, base := path.Split(name)
+		switch {
+		case base == ".wh..wh..opq":
+			// Opaque whiteout, hides the content of the directory in lower layers
+			deleteLayerFiles(files, strings.TrimSuffix(dir, "/"), false)
+		case strings.HasPrefix(base, ".wh."):
+			deleteLayerFiles(files, dir+strings.TrimPrefix(base, ".wh."), true)
+		case strings.HasPrefix(name, ResourceDir+"/"):
+			deleteLayerFiles(files, name, header.Typeflag != tar.TypeDir)
+			file := &layerFile{header: header}
+			if header.Typeflag == tar.TypeReg || header.Typeflag == tar.TypeRegA {
+				if file.data, err = ioutil.ReadAll(tr); err != nil {
+					return err
+				}
+			}
+			files[name] = file
+		}
+	}
+}
+
+// Deletes the files under the given path, and the path itself if required
+func deleteLayerFiles(files map[string]*layerFile, p string, deleteItself bool) {
+	for name := range files {
+		if strings.HasPrefix(name, p+"/") || (deleteItself && name == p) {
+			delete(files, name)
+		}
+	}
+}
+
+// Builds the layer which moves the content of the resource directory to
+// the wrapped one, and adds smuggler with its configuration.
+func buildInjectLayer(files map[string]*layerFile, options InjectOptions) ([]byte, error) {
+	resourcePrefix := ResourceDir + "/"
+	wrappedPrefix := resourcePrefix + WrappedDir + "/" + options.Name + "/"
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	// Parents before their content
+	sort.Strings(names)
+
+	// Injected before, only update smuggler and its configuration
+	_, injected := files[resourcePrefix+"smuggler"]
+
+	toMove := []string{}
+	topLevel := []string{}
+	if !injected {
+		for _, name := range names {
+			rel := strings.TrimPrefix(name, resourcePrefix)
+			if rel == WrappedDir || strings.HasPrefix(rel, WrappedDir+"/") {
+				if name+"/" == wrappedPrefix || strings.HasPrefix(name, wrappedPrefix) {
+					return nil, fmt.Errorf("'/%s' already exists, use another name", strings.TrimSuffix(wrappedPrefix, "/"))
+				}
+				continue
+			}
+			toMove = append(toMove, name)
+			if !strings.Contains(rel, "/") {
+				topLevel = append(topLevel, rel)
+			}
+		}
+	}
+
+	now := time.Now()
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	writeDir := func(name string) error {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir, Name: name, Mode: 0755, ModTime: now,
+		})
+	}
+	writeFile := func(name string, mode int64, data []byte) error {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: name, Mode: mode, Size: int64(len(data)), ModTime: now,
+		})
+		if err == nil {
+			_, err = tw.Write(data)
+		}
+		return err
+	}
+	writeLink := func(name string, target string) error {
+		return tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeLink, Name: name, Linkname: target, Mode: 0755, ModTime: now,
+		})
+	}
+
+	for _, dir := range []string{"opt/", resourcePrefix} {
+		if err := writeDir(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(toMove) > 0 {
+		if err := writeDir(resourcePrefix + WrappedDir + "/"); err != nil {
+			return nil, err
+		}
+		if err := writeDir(wrappedPrefix); err != nil {
+			return nil, err
+		}
+		for _, name := range toMove {
+			file := files[name]
+			header := *file.header
+			header.Name = wrappedPrefix + strings.TrimPrefix(name, resourcePrefix)
+			// Or they would take precedence over the new paths
+			header.PAXRecords = copyStringMapWithout(header.PAXRecords, "path", "linkpath")
+			if header.Typeflag == tar.TypeDir {
+				header.Name += "/"
+			}
+			if header.Typeflag == tar.TypeLink {
+				if target := cleanTarPath(header.Linkname); strings.HasPrefix(target, resourcePrefix) {
+					header.Linkname = wrappedPrefix + strings.TrimPrefix(target, resourcePrefix)
+				}
+			}
+			if err := tw.WriteHeader(&header); err != nil {
+				return nil, err
+			}
+			if _, err := tw.Write(file.data); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range topLevel {
+			if err := writeFile(resourcePrefix+".wh."+name, 0644, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	smugglerPath := resourcePrefix + "smuggler"
+	if err := writeFile(smugglerPath, 0755, options.Binary); err != nil {
+		return nil, err
+	}
+	for _, name := range commandNames {
+		if err := writeLink(resourcePrefix+name, smugglerPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeFile(resourcePrefix+"smuggler.yml", 0644, options.Config); err != nil {
+		return nil, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func copyStringMapWithout(m map[string]string, keys ...string) map[string]string {
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		if !contains(keys, k) {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// Path in a layer, without leading `./` or `/` or trailing `/`
+func cleanTarPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func maybeGzipReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+func blobPath(layoutDir string, digest interface{}) (string, error) {
+	d, _ := digest.(string)
+	m := digestPattern.FindStringSubmatch(d)
+	if m == nil {
+		return "", fmt.Errorf("invalid digest '%v'", digest)
+	}
+	return filepath.Join(layoutDir, "blobs", m[1], m[2]), nil
+}
+
+func readJsonBlob(layoutDir string, digest interface{}, v interface{}) error {
+	p, err := blobPath(layoutDir, digest)
+	if err != nil {
+		return err
+	}
+	return readJsonFile(p, v)
+}
+
+func readJsonFile(p string, v interface{}) error {
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("parsing '%s': %s", p, err)
+	}
+	return nil
+}
+
+// Writes the content as a blob, returning its descriptor
+func writeBlob(layoutDir string, content []byte) (map[string]interface{}, error) {
+	hex := fmt.Sprintf("%x", sha256.Sum256(content))
+	dir := filepath.Join(layoutDir, "blobs", "sha256")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, hex), content, 0644); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"digest": "sha256:" + hex,
+		"size":   len(content),
+	}, nil
+}
+
+func writeJsonBlob(layoutDir string, v interface{}) (map[string]interface{}, error) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return writeBlob(layoutDir, content)
+}
+
+func extractTarball(tarball string, dir string) error {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := maybeGzipReader(f)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanTarPath(header.Name)
+		if name == "" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected entry '%s' of type %c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+func createTarball(dir string, tarball string) error {
+	out, err := os.Create(tarball)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	tw := tar.NewWriter(out)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+			return tw.WriteHeader(header)
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,276 @@
+package smuggler_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var injectOptions = InjectOptions{
+	Name:   "s3",
+	Config: []byte("commands:\n  check: echo check\n"),
+	Binary: []byte("smuggler binary"),
+}
+
+func writeTestFile(path string, content string, mode os.FileMode) {
+	Ω(os.MkdirAll(filepath.Dir(path), 0755)).Should(Succeed())
+	Ω(ioutil.WriteFile(path, []byte(content), mode)).Should(Succeed())
+}
+
+func readTestFile(path string) string {
+	b, err := ioutil.ReadFile(path)
+	Ω(err).ShouldNot(HaveOccurred())
+	return string(b)
+}
+
+var _ = Describe("Inject in a rootfs", func() {
+	var rootfs, resourceDir string
+
+	BeforeEach(func() {
+		rootfs, err = ioutil.TempDir("", "rootfs")
+		Ω(err).ShouldNot(HaveOccurred())
+		resourceDir = filepath.Join(rootfs, "opt", "resource")
+		for _, name := range []string{"check", "in", "out"} {
+			writeTestFile(filepath.Join(resourceDir, name), "original "+name, 0755)
+		}
+		writeTestFile(filepath.Join(resourceDir, "common.sh"), "common", 0644)
+	})
+	AfterEach(func() {
+		os.RemoveAll(rootfs)
+	})
+
+	It("moves the original content to the wrapped directory", func() {
+		Ω(Inject(rootfs, injectOptions)).Should(Succeed())
+		Ω(readTestFile(filepath.Join(resourceDir, "wrapped", "s3", "check"))).Should(Equal("original check"))
+		Ω(readTestFile(filepath.Join(resourceDir, "wrapped", "s3", "common.sh"))).Should(Equal("common"))
+		_, err := os.Stat(filepath.Join(resourceDir, "common.sh"))
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+	})
+
+	It("writes smuggler with the commands as hardlinks and the config", func() {
+		Ω(Inject(rootfs, injectOptions)).Should(Succeed())
+		smugglerInfo, err := os.Stat(filepath.Join(resourceDir, "smuggler"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(smugglerInfo.Mode().Perm()).Should(Equal(os.FileMode(0755)))
+		for _, name := range []string{"check", "in", "out"} {
+			info, err := os.Stat(filepath.Join(resourceDir, name))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(os.SameFile(smugglerInfo, info)).Should(BeTrue())
+		}
+		Ω(readTestFile(filepath.Join(resourceDir, "smuggler.yml"))).Should(Equal(string(injectOptions.Config)))
+	})
+
+	It("only updates smuggler and the config when injected again", func() {
+		Ω(Inject(rootfs, injectOptions)).Should(Succeed())
+		options := injectOptions
+		options.Binary = []byte("new smuggler binary")
+		Ω(Inject(rootfs, options)).Should(Succeed())
+		Ω(readTestFile(filepath.Join(resourceDir, "check"))).Should(Equal("new smuggler binary"))
+		Ω(readTestFile(filepath.Join(resourceDir, "wrapped", "s3", "check"))).Should(Equal("original check"))
+		_, err := os.Stat(filepath.Join(resourceDir, "wrapped", "s3", "smuggler"))
+		Ω(os.IsNotExist(err)).Should(BeTrue())
+	})
+
+	It("fails if the wrapped directory already exists", func() {
+		writeTestFile(filepath.Join(resourceDir, "wrapped", "s3", "check"), "other", 0755)
+		Ω(Inject(rootfs, injectOptions)).Should(MatchError(ContainSubstring("'/opt/resource/wrapped/s3' already exists")))
+	})
+
+	It("fails with invalid names", func() {
+		options := injectOptions
+		options.Name = "../s3"
+		Ω(Inject(rootfs, options)).Should(MatchError("invalid name '../s3'"))
+	})
+})
+
+var _ = Describe("ReadInjectConfig", func() {
+	It("fails with an invalid smuggler.yml", func() {
+		f, err := ioutil.TempFile("", "smuggler.yml")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.Remove(f.Name())
+		f.WriteString("output_mode: everything\n")
+		f.Close()
+
+		_, err = ReadInjectConfig(f.Name())
+		Ω(err).Should(MatchError(ContainSubstring("smuggler.yml: output_mode: ")))
+	})
+})
+
+func runShell(cmd string) error {
+	return exec.Command("sh", "-c", cmd).Run()
+}
+
+// Minimal OCI image layout with a single image and the given layer
+func writeOciLayout(dir string, layer map[string]string) {
+	buffer := new(bytes.Buffer)
+	tw := tar.NewWriter(buffer)
+	for _, name := range []string{"opt/resource/check", "opt/resource/in", "opt/resource/out", "opt/resource/common.sh"} {
+		content := layer[name]
+		Ω(tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content))})).Should(Succeed())
+		tw.Write([]byte(content))
+	}
+	Ω(tw.Close()).Should(Succeed())
+	diffID := fmt.Sprintf("sha256:%x", sha256.Sum256(buffer.Bytes()))
+
+	writeBlob := func(content []byte) map[string]interface{} {
+		hex := fmt.Sprintf("%x", sha256.Sum256(content))
+		writeTestFile(filepath.Join(dir, "blobs", "sha256", hex), string(content), 0644)
+		return map[string]interface{}{"digest": "sha256:" + hex, "size": len(content)}
+	}
+	writeJsonBlob := func(v interface{}) map[string]interface{} {
+		b, err := json.Marshal(v)
+		Ω(err).ShouldNot(HaveOccurred())
+		return writeBlob(b)
+	}
+
+	layerDescriptor := writeBlob(buffer.Bytes())
+	layerDescriptor["mediaType"] = "application/vnd.oci.image.layer.v1.tar"
+	configDescriptor := writeJsonBlob(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{diffID}},
+		"history":      []interface{}{map[string]interface{}{"created_by": "test"}},
+	})
+	configDescriptor["mediaType"] = "application/vnd.oci.image.config.v1+json"
+	manifestDescriptor := writeJsonBlob(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        configDescriptor,
+		"layers":        []interface{}{layerDescriptor},
+	})
+	manifestDescriptor["mediaType"] = "application/vnd.oci.image.manifest.v1+json"
+	manifestDescriptor["annotations"] = map[string]string{"org.opencontainers.image.ref.name": "latest"}
+	index, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []interface{}{manifestDescriptor},
+	})
+	writeTestFile(filepath.Join(dir, "index.json"), string(index), 0644)
+	writeTestFile(filepath.Join(dir, "oci-layout"), `{"imageLayoutVersion": "1.0.0"}`, 0644)
+}
+
+func readOciJsonBlob(dir string, digest interface{}, v interface{}) {
+	hex := digest.(string)[len("sha256:"):]
+	Ω(json.Unmarshal([]byte(readTestFile(filepath.Join(dir, "blobs", "sha256", hex))), v)).Should(Succeed())
+}
+
+// Returns the manifest, config and the entries of the last layer of the
+// image in the OCI image layout
+func readOciImage(dir string) (map[string]interface{}, map[string]interface{}, map[string]*tar.Header, map[string]string) {
+	var index map[string]interface{}
+	Ω(json.Unmarshal([]byte(readTestFile(filepath.Join(dir, "index.json"))), &index)).Should(Succeed())
+	manifests := index["manifests"].([]interface{})
+	Ω(manifests).Should(HaveLen(1))
+	descriptor := manifests[0].(map[string]interface{})
+	Ω(descriptor).Should(HaveKey("annotations"))
+
+	var manifest, config map[string]interface{}
+	readOciJsonBlob(dir, descriptor["digest"], &manifest)
+	readOciJsonBlob(dir, manifest["config"].(map[string]interface{})["digest"], &config)
+
+	layers := manifest["layers"].([]interface{})
+	lastLayer := layers[len(layers)-1].(map[string]interface{})
+	f, err := os.Open(filepath.Join(dir, "blobs", "sha256", lastLayer["digest"].(string)[len("sha256:"):]))
+	Ω(err).ShouldNot(HaveOccurred())
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	Ω(err).ShouldNot(HaveOccurred())
+	tr := tar.NewReader(gz)
+	headers := map[string]*tar.Header{}
+	contents := map[string]string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		Ω(err).ShouldNot(HaveOccurred())
+		b, _ := ioutil.ReadAll(tr)
+		headers[header.Name] = header
+		contents[header.Name] = string(b)
+	}
+	return manifest, config, headers, contents
+}
+
+var _ = Describe("Inject in an OCI image layout", func() {
+	var layoutDir string
+
+	BeforeEach(func() {
+		layoutDir, err = ioutil.TempDir("", "oci-layout")
+		Ω(err).ShouldNot(HaveOccurred())
+		writeOciLayout(layoutDir, map[string]string{
+			"opt/resource/check": "original check",
+		})
+	})
+	AfterEach(func() {
+		os.RemoveAll(layoutDir)
+	})
+
+	It("adds a layer to the image", func() {
+		Ω(Inject(layoutDir, injectOptions)).Should(Succeed())
+		manifest, config, _, _ := readOciImage(layoutDir)
+		Ω(manifest["layers"]).Should(HaveLen(2))
+		Ω(manifest["layers"].([]interface{})[1]).Should(HaveKeyWithValue("mediaType", "application/vnd.oci.image.layer.v1.tar+gzip"))
+		Ω(config["rootfs"].(map[string]interface{})["diff_ids"]).Should(HaveLen(2))
+		Ω(config["history"]).Should(HaveLen(2))
+		Ω(config).Should(HaveKeyWithValue("architecture", "amd64"))
+	})
+
+	It("moves the original content to the wrapped directory", func() {
+		Ω(Inject(layoutDir, injectOptions)).Should(Succeed())
+		_, _, headers, contents := readOciImage(layoutDir)
+		Ω(contents).Should(HaveKeyWithValue("opt/resource/wrapped/s3/check", "original check"))
+		Ω(headers).Should(HaveKey("opt/resource/wrapped/s3/common.sh"))
+		Ω(headers).Should(HaveKey("opt/resource/.wh.check"))
+		Ω(headers).Should(HaveKey("opt/resource/.wh.common.sh"))
+	})
+
+	It("writes smuggler with the commands as hardlinks and the config", func() {
+		Ω(Inject(layoutDir, injectOptions)).Should(Succeed())
+		_, _, headers, contents := readOciImage(layoutDir)
+		Ω(contents).Should(HaveKeyWithValue("opt/resource/smuggler", "smuggler binary"))
+		Ω(headers["opt/resource/smuggler"].Mode).Should(Equal(int64(0755)))
+		for _, name := range []string{"check", "in", "out"} {
+			Ω(headers["opt/resource/"+name].Typeflag).Should(Equal(byte(tar.TypeLink)))
+			Ω(headers["opt/resource/"+name].Linkname).Should(Equal("opt/resource/smuggler"))
+		}
+		Ω(contents).Should(HaveKeyWithValue("opt/resource/smuggler.yml", string(injectOptions.Config)))
+	})
+
+	It("only updates smuggler and the config when injected again", func() {
+		Ω(Inject(layoutDir, injectOptions)).Should(Succeed())
+		Ω(Inject(layoutDir, injectOptions)).Should(Succeed())
+		manifest, _, headers, _ := readOciImage(layoutDir)
+		Ω(manifest["layers"]).Should(HaveLen(3))
+		Ω(headers).ShouldNot(HaveKey("opt/resource/.wh.check"))
+		Ω(headers).ShouldNot(HaveKey("opt/resource/wrapped/s3/smuggler"))
+	})
+
+	It("injects in an OCI image layout tarball", func() {
+		tarball := layoutDir + ".tar"
+		defer os.Remove(tarball)
+		cmd := fmt.Sprintf("tar -C %s -cf %s .", layoutDir, tarball)
+		Ω(runShell(cmd)).Should(Succeed())
+
+		Ω(Inject(tarball, injectOptions)).Should(Succeed())
+
+		extracted, err := ioutil.TempDir("", "oci-layout-extracted")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(extracted)
+		Ω(runShell(fmt.Sprintf("tar -C %s -xf %s", extracted, tarball))).Should(Succeed())
+		manifest, _, _, contents := readOciImage(extracted)
+		Ω(manifest["layers"]).Should(HaveLen(2))
+		Ω(contents).Should(HaveKeyWithValue("opt/resource/smuggler", "smuggler binary"))
+	})
+})
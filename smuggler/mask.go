@@ -0,0 +1,155 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const maskedValue = "***"
+
+// Names of parameters which are considered secret by default
+var secretParamNamePattern = regexp.MustCompile(
+	`(?i)(password|passwd|secret|token|private_key|access_key|api_key|credential)`,
+)
+
+// Common credentials, which are always masked
+var secretValuePatterns = []*regexp.Regexp{
+	// AWS access key IDs
+	regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`),
+	// PEM private keys
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----(?s:.*?)-----END [A-Z ]*PRIVATE KEY-----`),
+}
+
+// Replaces the values of the secret parameters with `***`
+type SecretMasker struct {
+	secrets []string
+}
+
+// Creates a masker for the secret params of the request: the ones listed in
+// `secret_params`, declared as `sensitive` in `params_schema`, with a name
+// like a credential or with a value matching a common credential pattern.
+func NewSecretMasker(request *ResourceRequest) *SecretMasker {
+	masker := &SecretMasker{}
+
+	params := copyMaps(
+		request.Source.SmugglerParams,
+		request.Source.ExtraParams,
+		request.Params.SmugglerParams,
+		request.Params.ExtraParams,
+	)
+	for name, value := range params {
+		if request.Source.IsSecretParam(name) || matchesSecretValuePattern(value) {
+			masker.AddSecret(InterfaceToJsonString(value))
+		}
+	}
+	if store := request.Source.VersionStore; store != nil {
+		masker.AddSecret(store.SecretAccessKey)
+		masker.AddSecret(store.SessionToken)
+	}
+	return masker
+}
+
+// If the param is declared as secret, or its name looks like a credential
+func (source SmugglerSource) IsSecretParam(name string) bool {
+	for _, s := range source.SecretParams {
+		if s == name {
+			return true
+		}
+	}
+	if definition, ok := source.ParamsSchema[name]; ok && definition.Sensitive {
+		return true
+	}
+	return secretParamNamePattern.MatchString(name)
+}
+
+func matchesSecretValuePattern(value interface{}) bool {
+	s, ok := value.(string)
+	if !ok {
+		return false
+	}
+	for _, p := range secretValuePatterns {
+		if p.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Secrets shorter than this are not masked, as they would mask random text
+const minSecretLength = 3
+
+// Adds a secret value to mask. Multiline values are masked also line by
+// line, as the output of the commands is processed by lines.
+func (masker *SecretMasker) AddSecret(secret string) {
+	candidates := []string{secret}
+	if strings.Contains(secret, "\n") {
+		for _, l := range strings.Split(secret, "\n") {
+			candidates = append(candidates, strings.TrimSpace(l))
+		}
+	}
+	for _, c := range candidates {
+		if len(c) < minSecretLength {
+			continue
+		}
+		masker.secrets = append(masker.secrets, c)
+		// As it would appear in JSON, e.g. in the logged request
+		if b, err := json.Marshal(c); err == nil {
+			if escaped := string(b[1 : len(b)-1]); escaped != c {
+				masker.secrets = append(masker.secrets, escaped)
+			}
+		}
+	}
+	// Replace the longest first, in case some secret contains other
+	sort.SliceStable(masker.secrets, func(i, j int) bool {
+		return len(masker.secrets[i]) > len(masker.secrets[j])
+	})
+}
+
+func (masker *SecretMasker) Mask(s string) string {
+	if masker == nil {
+		return s
+	}
+	for _, secret := range masker.secrets {
+		s = strings.Replace(s, secret, maskedValue, -1)
+	}
+	for _, p := range secretValuePatterns {
+		s = p.ReplaceAllString(s, maskedValue)
+	}
+	return s
+}
+
+// Returns the error with the secrets masked, as the errors are printed to
+// stderr without the logger
+func (masker *SecretMasker) MaskError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(masker.Mask(err.Error()))
+}
+
+// Returns a writer which masks the secrets of each write
+func (masker *SecretMasker) Writer(w io.Writer) io.Writer {
+	return &maskedWriter{out: w, masker: masker}
+}
+
+// Returns a logger like the given one which masks the secrets
+func (masker *SecretMasker) WrapLogger(logger *log.Logger) *log.Logger {
+	return log.New(masker.Writer(logger.Writer()), logger.Prefix(), logger.Flags())
+}
+
+type maskedWriter struct {
+	out    io.Writer
+	masker *SecretMasker
+}
+
+func (w *maskedWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, w.masker.Mask(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
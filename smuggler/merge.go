@@ -0,0 +1,159 @@
+package smuggler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// How a value of the configuration is merged with the one of the previous
+// layers: the files of smuggler configuration and then the pipeline
+type MergeStrategy string
+
+const (
+	// Maps are merged recursively, any other value of the layer replaces
+	// the previous one
+	MergeStrategyMerge MergeStrategy = "merge"
+	// The value of the layer replaces the previous one
+	MergeStrategyReplace MergeStrategy = "replace"
+	// The list of the layer is appended to the previous one
+	MergeStrategyAppend MergeStrategy = "append"
+)
+
+var mergeStrategies = []string{string(MergeStrategyMerge), string(MergeStrategyReplace), string(MergeStrategyAppend)}
+
+// Key of smuggler.yml with the merge strategies by path, like
+// `smuggler_params.tags: append`
+const MergeStrategiesKey = "merge_strategies"
+
+// Origin of the values of the source of the pipeline
+const OriginPipeline = "pipeline"
+
+// Origin of each value of the merged source, by path
+type ConfigOrigins map[string]string
+
+// Returns the paths sorted with their origins, one per line
+func (origins ConfigOrigins) String() string {
+	paths := make([]string, 0, len(origins))
+	for p := range origins {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	lines := make([]string, 0, len(paths))
+	for _, p := range paths {
+		lines = append(lines, fmt.Sprintf("%s: %s", p, origins[p]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The commands and hooks are replaced, as merging their definitions would
+// mix the path of one with the args of the other
+func defaultMergeStrategies() map[string]MergeStrategy {
+	strategies := map[string]MergeStrategy{}
+	for _, action := range commandNames {
+		strategies[joinPath("commands", action)] = MergeStrategyReplace
+		for _, hook := range hookTypes {
+			strategies[joinPath("hooks", hook)] = MergeStrategyReplace
+			strategies[joinPath(joinPath("hooks", action), hook)] = MergeStrategyReplace
+		}
+	}
+	return strategies
+}
+
+// Merges recursively the override into the base, the override taking
+// precedence at every level unless the strategy of the path says
+// otherwise. The origins of the base are updated with the ones of the
+// values taken from the override.
+func mergeConfig(base map[string]interface{}, override map[string]interface{}, overrideOrigin string, strategies map[string]MergeStrategy, origins ConfigOrigins) (map[string]interface{}, error) {
+	allStrategies := defaultMergeStrategies()
+	for p, s := range strategies {
+		allStrategies[p] = s
+	}
+	merged, err := mergeValues("", base, override, overrideOrigin, allStrategies, origins)
+	if err != nil {
+		return nil, err
+	}
+	m, _ := merged.(map[string]interface{})
+	return m, nil
+}
+
+func mergeValues(path string, base interface{}, override interface{}, overrideOrigin string, strategies map[string]MergeStrategy, origins ConfigOrigins) (interface{}, error) {
+	// A null value does not override
+	if override == nil {
+		return base, nil
+	}
+	if base == nil {
+		origins.record(path, override, overrideOrigin)
+		return override, nil
+	}
+
+	baseMap, baseIsMap := base.(map[string]interface{})
+	overrideMap, overrideIsMap := override.(map[string]interface{})
+	switch strategies[path] {
+	case MergeStrategyReplace:
+		origins.record(path, override, overrideOrigin)
+		return override, nil
+	case MergeStrategyAppend:
+		baseList, baseIsList := base.([]interface{})
+		overrideList, overrideIsList := override.([]interface{})
+		if !baseIsList || !overrideIsList {
+			return nil, fmt.Errorf(
+				"merging '%s': strategy '%s' requires lists, got %s and %s from %s",
+				path, MergeStrategyAppend, typeName(base), typeName(override), overrideOrigin,
+			)
+		}
+		origins[path] = origins[path] + "+" + overrideOrigin
+		return append(append([]interface{}{}, baseList...), overrideList...), nil
+	}
+
+	if !baseIsMap || !overrideIsMap {
+		origins.record(path, override, overrideOrigin)
+		return override, nil
+	}
+	merged := make(map[string]interface{}, len(baseMap)+len(overrideMap))
+	for _, k := range sortedKeys(copyMaps(baseMap, overrideMap)) {
+		v, err := mergeValues(joinPath(path, k), baseMap[k], overrideMap[k], overrideOrigin, strategies, origins)
+		if err != nil {
+			return nil, err
+		}
+		merged[k] = v
+	}
+	return merged, nil
+}
+
+// Records the origin of the value, or of each value in it if it is a map,
+// replacing the origins of the value it overrides
+func (origins ConfigOrigins) record(path string, v interface{}, origin string) {
+	origins.forget(path)
+	origins.recordValue(path, v, origin)
+}
+
+// Removes the origins of the value, and of each value in it
+func (origins ConfigOrigins) forget(path string) {
+	for p := range origins {
+		if path == "" || p == path || strings.HasPrefix(p, path+".") {
+			delete(origins, p)
+		}
+	}
+}
+
+func (origins ConfigOrigins) recordValue(path string, v interface{}, origin string) {
+	if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+		for k, e := range m {
+			origins.recordValue(joinPath(path, k), e, origin)
+		}
+		return
+	}
+	if path != "" {
+		origins[path] = origin
+	}
+}
+
+// Returns a copy of the origins
+func (origins ConfigOrigins) copy() ConfigOrigins {
+	c := make(ConfigOrigins, len(origins))
+	for p, o := range origins {
+		c[p] = o
+	}
+	return c
+}
@@ -0,0 +1,78 @@
+package smuggler_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var _ = Describe("ParseInputAndConfig merging smuggler.yml", func() {
+	config := []byte(`
+merge_strategies:
+  smuggler_params.tags: append
+  smuggler_params.replaced: replace
+timeout: 1m
+output_mode: stdout
+commands:
+  check:
+    path: bash
+    args: [ "-c", "echo config" ]
+  in: echo in
+smuggler_params:
+  region: eu-west-1
+  tags: [ a ]
+  nested: { a: 1, b: 2 }
+  replaced: { a: 1 }
+`)
+	input := []byte(`{
+		"source": {
+			"output_mode": "both",
+			"commands": { "check": { "path": "sh" } },
+			"smuggler_params": {
+				"tags": [ "b" ],
+				"nested": { "b": 3 },
+				"replaced": { "b": 2 },
+				"region": null
+			}
+		}
+	}`)
+
+	BeforeEach(func() {
+		smugglerConfig, err := ParseSmugglerConfig(config, "smuggler.yml")
+		Ω(err).ShouldNot(HaveOccurred())
+		request = ParseInputAndConfig(CheckType, input, smugglerConfig)
+	})
+
+	It("gives precedence to the pipeline at every level", func() {
+		Ω(request.Source.Timeout).Should(Equal("1m"))
+		Ω(request.Source.OutputMode).Should(Equal("both"))
+		Ω(request.Source.SmugglerParams["region"]).Should(Equal("eu-west-1"))
+		Ω(request.Source.SmugglerParams["nested"]).Should(Equal(map[string]interface{}{"a": 1.0, "b": 3.0}))
+	})
+
+	It("replaces the commands instead of merging them", func() {
+		Ω(request.Source.Commands["check"]).Should(Equal(map[string]interface{}{"path": "sh"}))
+		Ω(request.Source.Commands["in"]).Should(Equal("echo in"))
+	})
+
+	It("applies the merge strategies of smuggler.yml", func() {
+		Ω(request.Source.SmugglerParams["tags"]).Should(Equal([]interface{}{"a", "b"}))
+		Ω(request.Source.SmugglerParams["replaced"]).Should(Equal(map[string]interface{}{"b": 2.0}))
+		Ω(request.Source.ExtraParams).ShouldNot(HaveKey("merge_strategies"))
+	})
+
+	It("records the origin of each value", func() {
+		Ω(request.ConfigOrigins).Should(Equal(ConfigOrigins{
+			"commands.check.path":        "pipeline",
+			"commands.in":                "smuggler.yml",
+			"output_mode":                "pipeline",
+			"smuggler_params.nested.a":   "smuggler.yml",
+			"smuggler_params.nested.b":   "pipeline",
+			"smuggler_params.region":     "smuggler.yml",
+			"smuggler_params.replaced.b": "pipeline",
+			"smuggler_params.tags":       "smuggler.yml+pipeline",
+			"timeout":                    "smuggler.yml",
+		}))
+	})
+})
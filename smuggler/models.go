@@ -2,18 +2,41 @@ package smuggler
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/url"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
 )
 
 type SmugglerSource struct {
-	Commands         map[string]interface{} `json:"commands,omitempty"`
-	FilterRawRequest bool                   `json:"filter_raw_request,omitempty"`
-	SmugglerDebug    bool                   `json:"smuggler_debug,omitempty"`
-	SmugglerParams   map[string]interface{} `json:"smuggler_params,omitempty"`
-	ExtraParams      map[string]interface{} `json:"-"`
+	CheckCache          *CheckCacheDefinition   `json:"check_cache,omitempty"`
+	Commands            map[string]interface{}  `json:"commands,omitempty"`
+	DefaultCheckVersion interface{}             `json:"default_check_version,omitempty"`
+	DefaultInVersion    interface{}             `json:"default_in_version,omitempty"`
+	EnvCase             string                  `json:"env_case,omitempty"`
+	EnvFlatten          bool                    `json:"env_flatten,omitempty"`
+	EnvPrefix           *string                 `json:"env_prefix,omitempty"`
+	FilterRawRequest    bool                    `json:"filter_raw_request,omitempty"`
+	GracePeriod         string                  `json:"grace_period,omitempty"`
+	Hooks               map[string]interface{}  `json:"hooks,omitempty"`
+	OutputMode          string                  `json:"output_mode,omitempty"`
+	ParamsSchema        ParamsSchema            `json:"params_schema,omitempty"`
+	Profile             string                  `json:"profile,omitempty"`
+	ReplayDir           string                  `json:"replay_dir,omitempty"`
+	SecretParams        []string                `json:"secret_params,omitempty"`
+	SmugglerDebug       bool                    `json:"smuggler_debug,omitempty"`
+	SmugglerParams      map[string]interface{}  `json:"smuggler_params,omitempty"`
+	Templating          bool                    `json:"templating,omitempty"`
+	Timeout             string                  `json:"timeout,omitempty"`
+	VersionFilter       *VersionFilter          `json:"version_filter,omitempty"`
+	VersionOrder        string                  `json:"version_order,omitempty"`
+	VersionsFormat      string                  `json:"versions_format,omitempty"`
+	VersionStore        *VersionStoreDefinition `json:"version_store,omitempty"`
+	Wrap                *WrapDefinition         `json:"wrap,omitempty"`
+	ExtraParams         map[string]interface{}  `json:"-"`
 }
 
 func WrapCommandWithShell(name string, commandLine string) *CommandDefinition {
@@ -42,23 +65,76 @@ func WrapCommandWithShell(name string, commandLine string) *CommandDefinition {
 	}
 }
 
+// Returns the version to report if the given action does not report any,
+// or nil if there is no default version defined.
+func (source SmugglerSource) DefaultVersion(t RequestType) *Version {
+	var v interface{}
+	switch t {
+	case CheckType:
+		v = source.DefaultCheckVersion
+	case InType:
+		v = source.DefaultInVersion
+	}
+	if v == nil {
+		return nil
+	}
+	return NewVersion(InterfaceToJsonString(v))
+}
+
 func (source SmugglerSource) FindCommand(name string) (*CommandDefinition, error) {
 	cmd, ok := source.Commands[name]
 	if !ok {
 		return nil, nil
 	}
+	return source.newCommandDefinition(name, cmd)
+}
+
+// Builds the definition of a command, as a string with a shell script or
+// as a {path,args} hash
+func (source SmugglerSource) newCommandDefinition(name string, cmd interface{}) (*CommandDefinition, error) {
+	var c *CommandDefinition
 	switch cmd := cmd.(type) {
 	case string:
-		return WrapCommandWithShell(name, cmd), nil
+		c = WrapCommandWithShell(name, cmd)
 	default:
-		c, err := NewCommandDefinition(cmd)
-		return c, err
+		var err error
+		c, err = NewCommandDefinition(cmd)
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	// Commands inherit the global settings if they do not define them
+	if c.Timeout == "" {
+		c.Timeout = source.Timeout
+	}
+	if c.GracePeriod == "" {
+		c.GracePeriod = source.GracePeriod
+	}
+	return c, nil
 }
 
+const (
+	// Time to wait for the commands to stop after SIGTERM, before sending SIGKILL
+	DefaultGracePeriod = 10 * time.Second
+	// Delay before the first retry of a failed command, doubled on each retry
+	DefaultBackoff = 1 * time.Second
+	// Maximum delay between retries
+	DefaultMaxDelay = 1 * time.Minute
+)
+
 type CommandDefinition struct {
-	Path string   `json:"path"`
-	Args []string `json:"args,omitempty"`
+	Path             string   `json:"path"`
+	Args             []string `json:"args,omitempty"`
+	Engine           string   `json:"engine,omitempty"`
+	Script           string   `json:"script,omitempty"`
+	Timeout          string   `json:"timeout,omitempty"`
+	GracePeriod      string   `json:"grace_period,omitempty"`
+	Retries          int      `json:"retries,omitempty"`
+	Backoff          string   `json:"backoff,omitempty"`
+	MaxDelay         string   `json:"max_delay,omitempty"`
+	RetryOnExitCodes []int    `json:"retry_on_exit_codes,omitempty"`
+	CommandEnvironment
 }
 
 func NewCommandDefinition(i interface{}) (*CommandDefinition, error) {
@@ -78,7 +154,66 @@ func NewCommandDefinition(i interface{}) (*CommandDefinition, error) {
 }
 
 func (commandDefinition CommandDefinition) IsDefined() bool {
-	return (commandDefinition.Path != "")
+	return (commandDefinition.Path != "" || commandDefinition.Script != "")
+}
+
+// Returns the timeout and the grace period of the command.
+// A timeout of 0 means that the command never times out.
+func (commandDefinition CommandDefinition) Timeouts() (time.Duration, time.Duration, error) {
+	var timeout time.Duration
+	var gracePeriod = DefaultGracePeriod
+	var err error
+	if commandDefinition.Timeout != "" {
+		timeout, err = time.ParseDuration(commandDefinition.Timeout)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid timeout '%s': %s", commandDefinition.Timeout, err)
+		}
+	}
+	if commandDefinition.GracePeriod != "" {
+		gracePeriod, err = time.ParseDuration(commandDefinition.GracePeriod)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid grace_period '%s': %s", commandDefinition.GracePeriod, err)
+		}
+	}
+	return timeout, gracePeriod, nil
+}
+
+// Returns the delay before the first retry and the maximum delay between
+// retries of the command.
+func (commandDefinition CommandDefinition) Backoffs() (time.Duration, time.Duration, error) {
+	var backoff = DefaultBackoff
+	var maxDelay = DefaultMaxDelay
+	var err error
+	if commandDefinition.Backoff != "" {
+		backoff, err = time.ParseDuration(commandDefinition.Backoff)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid backoff '%s': %s", commandDefinition.Backoff, err)
+		}
+	}
+	if commandDefinition.MaxDelay != "" {
+		maxDelay, err = time.ParseDuration(commandDefinition.MaxDelay)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid max_delay '%s': %s", commandDefinition.MaxDelay, err)
+		}
+	}
+	if maxDelay < backoff {
+		maxDelay = backoff
+	}
+	return backoff, maxDelay, nil
+}
+
+// If the command must be retried when it fails with the given exit status.
+// With no retry_on_exit_codes, any failure is retried.
+func (commandDefinition CommandDefinition) RetriesOnExitStatus(exitStatus int) bool {
+	if len(commandDefinition.RetryOnExitCodes) == 0 {
+		return true
+	}
+	for _, c := range commandDefinition.RetryOnExitCodes {
+		if c == exitStatus {
+			return true
+		}
+	}
+	return false
 }
 
 type MetadataPair struct {
@@ -120,6 +255,10 @@ type ResourceRequest struct {
 	Params          TaskParams          `json:"params,omitempty"`
 	OrigRequest     *RawResourceRequest `json:"-"`
 	FilteredRequest *RawResourceRequest `json:"-"`
+	// Origin of the values of the source merged with smuggler.yml
+	ConfigOrigins ConfigOrigins `json:"-"`
+	// Keys of the source passed as parameters, but similar to smuggler keys
+	ValidationWarnings []string `json:"-"`
 }
 
 type Version map[string]string
@@ -146,6 +285,73 @@ func NewVersion(s string) *Version {
 	return &v
 }
 
+// Format of the lines of the versions file
+type VersionsFormat string
+
+const (
+	// A JSON object, or any other string as the ID
+	VersionsFormatPlain VersionsFormat = "plain"
+	// Tab separated key=value fields
+	VersionsFormatTsv VersionsFormat = "tsv"
+	// URL query like key=value&key=value fields, with URL encoded values
+	VersionsFormatQuery VersionsFormat = "query"
+)
+
+func NewVersionsFormat(s string) (VersionsFormat, error) {
+	switch f := VersionsFormat(s); f {
+	case "":
+		return VersionsFormatPlain, nil
+	case VersionsFormatPlain, VersionsFormatTsv, VersionsFormatQuery:
+		return f, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid versions_format '%s', must be one of: %s, %s, %s",
+			s, VersionsFormatPlain, VersionsFormatTsv, VersionsFormatQuery,
+		)
+	}
+}
+
+// Parses a version in the given format.
+func NewVersionWithFormat(s string, format VersionsFormat) (*Version, error) {
+	var fields []string
+	switch format {
+	case VersionsFormatPlain, "":
+		return NewVersion(s), nil
+	case VersionsFormatTsv:
+		fields = strings.Split(s, "\t")
+	case VersionsFormatQuery:
+		fields = strings.Split(s, "&")
+	default:
+		return nil, fmt.Errorf("invalid versions_format '%s'", format)
+	}
+
+	v := make(Version)
+	for _, f := range fields {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid field '%s', expected key=value", f)
+		}
+		k, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if format == VersionsFormatQuery {
+			var err error
+			if k, err = url.QueryUnescape(k); err != nil {
+				return nil, fmt.Errorf("invalid field '%s': %s", f, err)
+			}
+			if val, err = url.QueryUnescape(val); err != nil {
+				return nil, fmt.Errorf("invalid field '%s': %s", f, err)
+			}
+		}
+		if k == "" {
+			return nil, fmt.Errorf("invalid field '%s', empty key", f)
+		}
+		if _, ok := v[k]; ok {
+			return nil, fmt.Errorf("duplicated key '%s'", k)
+		}
+		v[k] = val
+	}
+	return &v, nil
+}
+
 func NewVersions(sl []string) []Version {
 	var vs []Version
 	vs = make([]Version, 0, len(sl))
@@ -201,6 +407,22 @@ func NewResourceRequest(requestType RequestType, jsonString string) (*ResourceRe
 	return &request, nil
 }
 
+// Returns the params from the source and the get/put step, overridden in
+// the order: source.smuggler_params, source, params.smuggler_params, params.
+// Checks them against the params_schema, setting the default values.
+func (request *ResourceRequest) AllParams() (map[string]interface{}, error) {
+	params := copyMaps(
+		request.Source.SmugglerParams,
+		request.Source.ExtraParams,
+		request.Params.SmugglerParams,
+		request.Params.ExtraParams,
+	)
+	if err := request.Source.ParamsSchema.Apply(request.Type, params); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
 func (request *ResourceRequest) ToJson() ([]byte, error) {
 	return json.Marshal(request)
 }
@@ -1,6 +1,8 @@
 package smuggler_test
 
 import (
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -113,3 +115,87 @@ var _ = Describe("NewVersion", func() {
 		Ω(b).Should(MatchJSON(`{"source":{},"version":{"ID": "{\"ID\": { \"a\": 1 } }"},"params":{}}`))
 	})
 })
+
+var _ = Describe("CommandDefinition timeouts", func() {
+	It("inherits the timeouts from the source if not defined", func() {
+		source := SmugglerSource{
+			Timeout: "1m",
+			Commands: map[string]interface{}{
+				"check": "echo check",
+				"in": map[string]interface{}{
+					"path":         "echo",
+					"timeout":      "10s",
+					"grace_period": "2s",
+				},
+			},
+		}
+		c, err := source.FindCommand("check")
+		Ω(err).ShouldNot(HaveOccurred())
+		timeout, gracePeriod, err := c.Timeouts()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(timeout).Should(Equal(time.Minute))
+		Ω(gracePeriod).Should(Equal(DefaultGracePeriod))
+
+		c, err = source.FindCommand("in")
+		Ω(err).ShouldNot(HaveOccurred())
+		timeout, gracePeriod, err = c.Timeouts()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(timeout).Should(Equal(10 * time.Second))
+		Ω(gracePeriod).Should(Equal(2 * time.Second))
+	})
+	It("fails with invalid durations", func() {
+		c := CommandDefinition{Path: "echo", Timeout: "forever"}
+		_, _, err := c.Timeouts()
+		Ω(err).Should(MatchError(ContainSubstring("invalid timeout 'forever'")))
+	})
+})
+
+var _ = Describe("CommandDefinition retries", func() {
+	It("uses default backoffs if not defined", func() {
+		c := CommandDefinition{Path: "echo", Retries: 2}
+		backoff, maxDelay, err := c.Backoffs()
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(backoff).Should(Equal(DefaultBackoff))
+		Ω(maxDelay).Should(Equal(DefaultMaxDelay))
+	})
+	It("retries on any exit status if retry_on_exit_codes is empty", func() {
+		c := CommandDefinition{Path: "echo", Retries: 2}
+		Ω(c.RetriesOnExitStatus(1)).Should(BeTrue())
+		Ω(c.RetriesOnExitStatus(TimeoutExitStatus)).Should(BeTrue())
+	})
+	It("retries only on the given exit codes", func() {
+		c := CommandDefinition{Path: "echo", Retries: 2, RetryOnExitCodes: []int{3, 5}}
+		Ω(c.RetriesOnExitStatus(3)).Should(BeTrue())
+		Ω(c.RetriesOnExitStatus(4)).Should(BeFalse())
+	})
+})
+
+var _ = Describe("NewVersionWithFormat", func() {
+	It("parses the plain format as NewVersion", func() {
+		v, err := NewVersionWithFormat("1.2.3", VersionsFormatPlain)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(v).Should(Equal(NewVersion("1.2.3")))
+	})
+	It("parses tab separated fields", func() {
+		v, err := NewVersionWithFormat("ref=abc\ttimestamp=123", VersionsFormatTsv)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(*v).Should(Equal(Version{"ref": "abc", "timestamp": "123"}))
+	})
+	It("parses URL query like fields", func() {
+		v, err := NewVersionWithFormat("ref=abc&msg=a%26b+c", VersionsFormatQuery)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(*v).Should(Equal(Version{"ref": "abc", "msg": "a&b c"}))
+	})
+	It("fails with fields without key", func() {
+		_, err := NewVersionWithFormat("=abc", VersionsFormatQuery)
+		Ω(err).Should(MatchError("invalid field '=abc', empty key"))
+	})
+	It("fails with duplicated keys", func() {
+		_, err := NewVersionWithFormat("ref=abc&ref=def", VersionsFormatQuery)
+		Ω(err).Should(MatchError("duplicated key 'ref'"))
+	})
+	It("fails with an unknown format", func() {
+		_, err := NewVersionsFormat("xml")
+		Ω(err).Should(MatchError(ContainSubstring("invalid versions_format 'xml'")))
+	})
+})
@@ -0,0 +1,99 @@
+package smuggler
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// How the stdout and stderr of the commands are echoed while they run
+type OutputMode string
+
+const (
+	// Both streams, each line prefixed with the name of the stream
+	OutputModeBothPrefix OutputMode = "both-prefix"
+	// Both streams, as they are
+	OutputModeBoth OutputMode = "both"
+	// Only stdout
+	OutputModeStdout OutputMode = "stdout"
+	// Only stderr
+	OutputModeStderr OutputMode = "stderr"
+
+	DefaultOutputMode = OutputModeBoth
+)
+
+func NewOutputMode(s string) (OutputMode, error) {
+	switch m := OutputMode(s); m {
+	case "":
+		return DefaultOutputMode, nil
+	case OutputModeBothPrefix, OutputModeBoth, OutputModeStdout, OutputModeStderr:
+		return m, nil
+	default:
+		return "", fmt.Errorf(
+			"invalid output_mode '%s', must be one of: %s, %s, %s, %s",
+			s, OutputModeBothPrefix, OutputModeBoth, OutputModeStdout, OutputModeStderr,
+		)
+	}
+}
+
+func (m OutputMode) echoStdout() bool {
+	return m != OutputModeStderr
+}
+
+func (m OutputMode) echoStderr() bool {
+	return m != OutputModeStdout
+}
+
+func (m OutputMode) prefix(stream string) string {
+	if m == OutputModeBothPrefix {
+		return stream + ": "
+	}
+	return ""
+}
+
+// Writer which forwards complete lines to a shared output, adding a prefix.
+// Several lineWriters can write to the same output safely as long as they
+// share the same mutex.
+type lineWriter struct {
+	out    io.Writer
+	mutex  *sync.Mutex
+	prefix string
+	buffer bytes.Buffer
+}
+
+func newLineWriter(out io.Writer, mutex *sync.Mutex, prefix string) *lineWriter {
+	return &lineWriter{out: out, mutex: mutex, prefix: prefix}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buffer.Write(p)
+	for {
+		i := bytes.IndexByte(w.buffer.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buffer.Next(i + 1)
+		if err := w.writeLine(line); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Write any pending incomplete line
+func (w *lineWriter) Flush() error {
+	if w.buffer.Len() == 0 {
+		return nil
+	}
+	line := append(w.buffer.Bytes(), '\n')
+	w.buffer.Reset()
+	return w.writeLine(line)
+}
+
+func (w *lineWriter) writeLine(line []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err := fmt.Fprintf(w.out, "%s%s", w.prefix, line)
+	return err
+}
@@ -0,0 +1,111 @@
+package smuggler
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Declaration of a parameter in `params_schema`
+type ParamDefinition struct {
+	Type      string        `json:"type,omitempty"`
+	Default   interface{}   `json:"default,omitempty"`
+	Required  bool          `json:"required,omitempty"`
+	Enum      []interface{} `json:"enum,omitempty"`
+	Actions   []RequestType `json:"actions,omitempty"`
+	Sensitive bool          `json:"sensitive,omitempty"`
+}
+
+// Types of parameters, as decoded from JSON
+var paramTypes = []string{"any", "string", "number", "integer", "boolean", "list", "map"}
+
+// Declaration of the parameters of the resource by name
+type ParamsSchema map[string]ParamDefinition
+
+// Error with the list of problems found in the parameters
+type ParamsError struct {
+	Problems []string
+}
+
+func (e *ParamsError) Error() string {
+	return fmt.Sprintf("invalid parameters:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+// Checks the params of the given action against the schema, and sets the
+// default value of the missing ones.
+func (schema ParamsSchema) Apply(action RequestType, params map[string]interface{}) error {
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	problems := []string{}
+	for _, name := range names {
+		definition := schema[name]
+		if !definition.AppliesTo(action) {
+			continue
+		}
+		value, ok := params[name]
+		if !ok || value == nil {
+			if definition.Default != nil {
+				params[name] = definition.Default
+			} else if definition.Required {
+				problems = append(problems, fmt.Sprintf("%s: required parameter for '%s' is missing", name, action))
+			}
+			continue
+		}
+		if !definition.matchesType(value) {
+			problems = append(problems, fmt.Sprintf("%s: expected %s, got %s", name, definition.Type, typeName(value)))
+			continue
+		}
+		if !definition.inEnum(value) {
+			problems = append(problems, fmt.Sprintf(
+				"%s: invalid value %s, must be one of: %s",
+				name, InterfaceToJsonString(value), InterfaceToJsonString(definition.Enum),
+			))
+		}
+	}
+	if len(problems) > 0 {
+		return &ParamsError{Problems: problems}
+	}
+	return nil
+}
+
+// If the parameter is used in the given action. By default in all of them.
+func (definition ParamDefinition) AppliesTo(action RequestType) bool {
+	if len(definition.Actions) == 0 {
+		return true
+	}
+	for _, a := range definition.Actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func (definition ParamDefinition) matchesType(value interface{}) bool {
+	switch definition.Type {
+	case "", "any":
+		return true
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == float64(int(f))
+	default:
+		return typeName(value) == definition.Type
+	}
+}
+
+func (definition ParamDefinition) inEnum(value interface{}) bool {
+	if len(definition.Enum) == 0 {
+		return true
+	}
+	for _, e := range definition.Enum {
+		if reflect.DeepEqual(e, value) {
+			return true
+		}
+	}
+	return false
+}
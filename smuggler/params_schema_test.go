@@ -0,0 +1,42 @@
+package smuggler_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var _ = Describe("ParamsSchema", func() {
+	var schema = ParamsSchema{
+		"name":    {Type: "string", Required: true},
+		"count":   {Type: "integer", Default: float64(1)},
+		"enabled": {Type: "boolean", Actions: []RequestType{OutType}},
+		"mode":    {Enum: []interface{}{"fast", "slow"}},
+	}
+
+	It("accepts valid params and sets the defaults", func() {
+		params := map[string]interface{}{"name": "foo", "mode": "fast"}
+		err := schema.Apply(InType, params)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(params).Should(Equal(map[string]interface{}{
+			"name": "foo", "mode": "fast", "count": float64(1),
+		}))
+	})
+	It("reports all the problems", func() {
+		params := map[string]interface{}{"count": 1.5, "enabled": "yes", "mode": "medium"}
+		err := schema.Apply(OutType, params)
+		Ω(err).Should(MatchError(
+			"invalid parameters:\n" +
+				"  - count: expected integer, got number\n" +
+				"  - enabled: expected boolean, got string\n" +
+				"  - mode: invalid value medium, must be one of: [\"fast\",\"slow\"]\n" +
+				"  - name: required parameter for 'out' is missing",
+		))
+	})
+	It("ignores the params not declared for the action", func() {
+		params := map[string]interface{}{"name": "foo", "enabled": "yes"}
+		err := schema.Apply(CheckType, params)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+})
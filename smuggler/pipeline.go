@@ -0,0 +1,96 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ghodss/yaml"
+)
+
+// The resources and jobs of a concourse pipeline, to build the requests
+// as concourse would do
+type Pipeline struct {
+	Resources []PipelineResource `json:"resources"`
+	Jobs      []PipelineJob      `json:"jobs"`
+}
+
+type PipelineResource struct {
+	Name   string                 `json:"name"`
+	Type   string                 `json:"type"`
+	Source map[string]interface{} `json:"source"`
+}
+
+type PipelineJob struct {
+	Name string         `json:"name"`
+	Plan []PipelineStep `json:"plan"`
+}
+
+type PipelineStep struct {
+	GetName string                 `json:"get"`
+	PutName string                 `json:"put"`
+	Params  map[string]interface{} `json:"params"`
+}
+
+func ParsePipeline(yamlManifest []byte) (*Pipeline, error) {
+	var pipeline Pipeline
+	if err := yaml.Unmarshal(yamlManifest, &pipeline); err != nil {
+		return nil, err
+	}
+	return &pipeline, nil
+}
+
+// Builds the request for the resource, with the params of the get or put
+// step of the job. The version is only sent to check and in.
+func (pipeline *Pipeline) RawRequest(requestType RequestType, resourceName string, jobName string, version Version) (*RawResourceRequest, error) {
+	var request RawResourceRequest
+
+	var resource *PipelineResource
+	for i, r := range pipeline.Resources {
+		if r.Name == resourceName {
+			resource = &pipeline.Resources[i]
+			break
+		}
+	}
+	if resource == nil {
+		return nil, fmt.Errorf("Cannot find a resource called '%s' in the pipeline.", resourceName)
+	}
+	request.Source = resource.Source
+
+	jobFound := jobName == ""
+	for _, j := range pipeline.Jobs {
+		if j.Name != jobName {
+			continue
+		}
+		jobFound = true
+		for _, t := range j.Plan {
+			if requestType == InType && t.GetName == resourceName {
+				request.Params = t.Params
+			}
+			if requestType == OutType && t.PutName == resourceName {
+				request.Params = t.Params
+			}
+		}
+	}
+	if !jobFound {
+		return nil, fmt.Errorf("Cannot find a job called '%s' in the pipeline.", jobName)
+	}
+
+	if requestType == InType || requestType == CheckType {
+		request.Version = version
+	}
+	return &request, nil
+}
+
+func (pipeline *Pipeline) JsonRequest(requestType RequestType, resourceName string, jobName string, version string) (string, error) {
+	request, err := pipeline.RawRequest(requestType, resourceName, jobName, *NewVersion(version))
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("Failed encoding request %q: %+v", err, request)
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,140 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Everything needed to run an action again exactly as it was run
+type ReplayBundle struct {
+	Created time.Time   `json:"created"`
+	Action  RequestType `json:"action"`
+	Args    []string    `json:"args"`
+	DataDir string      `json:"data_dir,omitempty"`
+	// The request as received from concourse
+	Input json.RawMessage `json:"input"`
+	// The request merged with smuggler.yml
+	Request *RawResourceRequest `json:"request"`
+	// The environment of smuggler, restored to replay
+	Env []string `json:"env"`
+	// The environment of the last command, with the params
+	CommandEnv []string          `json:"command_env,omitempty"`
+	Response   *ResourceResponse `json:"response,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	ExitStatus int               `json:"exit_status"`
+}
+
+const ReplayDirEnv = "SMUGGLER_REPLAY_DIR"
+
+// Directory to write the replay bundles, if any
+func (source SmugglerSource) ReplayDirectory() string {
+	if source.ReplayDir != "" {
+		return source.ReplayDir
+	}
+	return os.Getenv(ReplayDirEnv)
+}
+
+func NewReplayBundle(dataDir string, request *ResourceRequest, input []byte, commandEnv []string) *ReplayBundle {
+	bundle := &ReplayBundle{
+		Created:    time.Now().UTC(),
+		Action:     request.Type,
+		Args:       os.Args,
+		DataDir:    dataDir,
+		Request:    request.OrigRequest,
+		Env:        os.Environ(),
+		CommandEnv: commandEnv,
+	}
+	if json.Valid(input) {
+		bundle.Input = input
+	}
+	return bundle
+}
+
+// Records the result of the action
+func (bundle *ReplayBundle) SetResult(response *ResourceResponse, err error, exitStatus int) {
+	bundle.Response = response
+	if err != nil {
+		bundle.Error = err.Error()
+		bundle.ExitStatus = exitStatus
+	}
+}
+
+// Writes the bundle in the directory, only readable by the owner as it
+// contains the secrets. Returns the path of the bundle.
+func (bundle *ReplayBundle) Write(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	content, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf(
+		"%s-%s-%d.json", bundle.Created.Format("20060102T150405Z"), bundle.Action, os.Getpid(),
+	))
+	return path, ioutil.WriteFile(path, content, 0600)
+}
+
+func ReadReplayBundle(path string) (*ReplayBundle, error) {
+	var bundle ReplayBundle
+	if err := readJsonFile(path, &bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Request == nil {
+		return nil, fmt.Errorf("'%s' has no request to replay", path)
+	}
+	if !contains(commandNames, string(bundle.Action)) {
+		return nil, fmt.Errorf("'%s' has an invalid action '%s'", path, bundle.Action)
+	}
+	return &bundle, nil
+}
+
+// Replaces the environment with the one of the bundle, but the replay
+// directory, so the replay does not write another bundle
+func (bundle *ReplayBundle) RestoreEnv() error {
+	os.Clearenv()
+	for _, e := range bundle.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || kv[0] == ReplayDirEnv {
+			continue
+		}
+		if err := os.Setenv(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the merged request of the bundle, replacing the command of the
+// action with the given one if any. The replay directory is removed, so
+// the replay does not write another bundle.
+func (bundle *ReplayBundle) RequestJson(command string) ([]byte, error) {
+	request := *bundle.Request
+	source := copyMaps(request.Source)
+	delete(source, "replay_dir")
+	if command != "" {
+		commands, _ := source["commands"].(map[string]interface{})
+		commands = copyMaps(commands)
+		commands[string(bundle.Action)] = command
+		source["commands"] = commands
+	}
+	request.Source = source
+	return json.Marshal(request)
+}
+
+// Writes the bundle of the action if there is a replay directory. It
+// never fails the action, only logs the errors.
+func writeReplayBundle(bundle *ReplayBundle, dir string, logger *log.Logger) {
+	path, err := bundle.Write(dir)
+	if err != nil {
+		logger.Printf("[WARN] Cannot write the replay bundle in '%s': %s", dir, err)
+		return
+	}
+	logger.Printf("[INFO] Replay bundle written in '%s'", path)
+}
@@ -0,0 +1,71 @@
+package smuggler_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var _ = Describe("ReplayBundle", func() {
+	var replayDir string
+	var bundle *ReplayBundle
+
+	BeforeEach(func() {
+		replayDir, err = ioutil.TempDir("", "replay")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		input := `{"source": {"commands": {"check": "echo check"}, "param": "value", "replay_dir": "/tmp/replays"}}`
+		request, err = NewResourceRequest(CheckType, input)
+		Ω(err).ShouldNot(HaveOccurred())
+		bundle = NewReplayBundle("", request, []byte(input), []string{"SMUGGLER_param=value"})
+	})
+	AfterEach(func() {
+		os.RemoveAll(replayDir)
+	})
+
+	It("is written only readable by the owner", func() {
+		path, err := bundle.Write(replayDir)
+		Ω(err).ShouldNot(HaveOccurred())
+		info, err := os.Stat(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(info.Mode().Perm()).Should(Equal(os.FileMode(0600)))
+	})
+
+	It("is read back with the request, the environment and the result", func() {
+		bundle.SetResult(&ResourceResponse{Type: CheckType}, errors.New("failed"), 3)
+		path, err := bundle.Write(replayDir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		read, err := ReadReplayBundle(path)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(read.Action).Should(Equal(CheckType))
+		Ω(read.Request).Should(Equal(request.OrigRequest))
+		Ω(read.Env).Should(Equal(os.Environ()))
+		Ω(read.CommandEnv).Should(Equal([]string{"SMUGGLER_param=value"}))
+		Ω(read.Error).Should(Equal("failed"))
+		Ω(read.ExitStatus).Should(Equal(3))
+		Ω([]byte(read.Input)).Should(MatchJSON(`{"source": {"commands": {"check": "echo check"}, "param": "value", "replay_dir": "/tmp/replays"}}`))
+	})
+
+	It("replaces the command of the action", func() {
+		b, err := bundle.RequestJson("echo replaced")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b).Should(MatchJSON(`{"source": {"commands": {"check": "echo replaced"}, "param": "value"}}`))
+		// The bundle is not modified
+		b, err = json.Marshal(bundle.Request)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b).Should(MatchJSON(`{"source": {"commands": {"check": "echo check"}, "param": "value", "replay_dir": "/tmp/replays"}}`))
+	})
+
+	It("does not replay with the replay directory", func() {
+		b, err := bundle.RequestJson("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b).Should(MatchJSON(`{"source": {"commands": {"check": "echo check"}, "param": "value"}}`))
+	})
+})
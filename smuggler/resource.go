@@ -0,0 +1,112 @@
+package smuggler
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+)
+
+// Interface to implement a concourse resource in Go, instead of with
+// commands. See Serve()
+type Resource interface {
+	// Returns the versions found, from the request version included
+	Check(ctx context.Context, request *ResourceRequest) ([]Version, error)
+	// Fetches the request version into the destination directory
+	In(ctx context.Context, destinationDir string, request *ResourceRequest) (Version, []MetadataPair, error)
+	// Creates a new version from the files in the sources directory
+	Out(ctx context.Context, sourcesDir string, request *ResourceRequest) (Version, []MetadataPair, error)
+}
+
+type loggerContextKey struct{}
+
+// Returns the smuggler logger passed to the resource
+func ContextLogger(ctx context.Context) *log.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*log.Logger); ok {
+		return logger
+	}
+	return log.New(ioutil.Discard, "", 0)
+}
+
+// Entry point for resources implemented in Go. Call it from main() and
+// install the binary as /opt/resource/{check,in,out}.
+//
+// It works as the smuggler commands: it reads the request merged with
+// smuggler.yml, logs to /tmp/smuggler.log, checks the params_schema,
+// masks the secrets, applies the source timeout and default versions, and
+// writes the response.
+func Serve(resource Resource) {
+	defer utils.PrintRecover()
+
+	dataDir, requestType := ProcessArguments()
+
+	tempFileLogger := OpenSmugglerLog()
+	request, _ := InputRequest(requestType, tempFileLogger.Logger)
+	if request.Source.SmugglerDebug {
+		tempFileLogger.DupToStderr()
+	}
+	masker := NewSecretMasker(request)
+	logger := masker.WrapLogger(tempFileLogger.Logger)
+	for _, warning := range request.ValidationWarnings {
+		logger.Printf("[WARN] %s", warning)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	response, err := RunResource(ctx, resource, dataDir, request, logger)
+	if err != nil {
+		utils.Fatal("running resource", masker.MaskError(err), 1)
+	}
+
+	OutputResponse(response)
+}
+
+// Runs the action of the request with the given resource
+func RunResource(ctx context.Context, resource Resource, dataDir string, request *ResourceRequest, logger *log.Logger) (*ResourceResponse, error) {
+	logger.Printf("[INFO] Running %s action", string(request.Type))
+
+	var response = ResourceResponse{
+		Type: request.Type,
+	}
+
+	// Fail fast if the params do not match the params_schema
+	if _, err := request.AllParams(); err != nil {
+		return &response, err
+	}
+
+	if request.Source.Timeout != "" {
+		timeout, err := time.ParseDuration(request.Source.Timeout)
+		if err != nil {
+			return &response, err
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	ctx = context.WithValue(ctx, loggerContextKey{}, logger)
+
+	var err error
+	switch request.Type {
+	case CheckType:
+		response.Versions, err = resource.Check(ctx, request)
+	case InType:
+		response.Version, response.Metadata, err = resource.In(ctx, dataDir, request)
+	case OutType:
+		response.Version, response.Metadata, err = resource.Out(ctx, dataDir, request)
+	}
+	if err != nil {
+		return &response, err
+	}
+	useDefaultVersion(request, &response)
+
+	logger.Printf("[INFO] resource reports versions '%q'", response.Versions)
+	logger.Printf("[INFO] resource reports metadata '%q'", response.Metadata)
+
+	return &response, nil
+}
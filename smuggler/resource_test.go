@@ -0,0 +1,103 @@
+package smuggler_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+type fakeResource struct {
+	versions []Version
+	params   map[string]interface{}
+	deadline bool
+}
+
+func (r *fakeResource) Check(ctx context.Context, request *ResourceRequest) ([]Version, error) {
+	ContextLogger(ctx).Printf("checking from %s", request.Version.ToString())
+	_, r.deadline = ctx.Deadline()
+	return r.versions, nil
+}
+
+func (r *fakeResource) In(ctx context.Context, destinationDir string, request *ResourceRequest) (Version, []MetadataPair, error) {
+	params, err := request.AllParams()
+	r.params = params
+	return request.Version, []MetadataPair{{Name: "dir", Value: destinationDir}}, err
+}
+
+func (r *fakeResource) Out(ctx context.Context, sourcesDir string, request *ResourceRequest) (Version, []MetadataPair, error) {
+	return Version{"ID": "out"}, nil, nil
+}
+
+var _ = Describe("RunResource", func() {
+	var resource *fakeResource
+
+	runResource := func(t RequestType, requestJson string) (*ResourceResponse, error) {
+		request, err := NewResourceRequest(t, requestJson)
+		Ω(err).ShouldNot(HaveOccurred())
+		return RunResource(context.Background(), resource, "/some/path", request, logger)
+	}
+
+	BeforeEach(func() {
+		resource = &fakeResource{
+			versions: NewVersions([]string{"1", "2"}),
+		}
+	})
+
+	It("returns the versions from Check", func() {
+		response, err := runResource(CheckType, `{"source": {}, "version": {"ID": "1"}}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Type).Should(Equal(CheckType))
+		Ω(response.Versions).Should(Equal(resource.versions))
+		Ω(resource.deadline).Should(BeFalse())
+	})
+	It("returns the default check version if Check does not return versions", func() {
+		resource.versions = nil
+		response, err := runResource(CheckType, `{"source": {"default_check_version": "static"}}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{{"ID": "static"}}))
+	})
+	It("applies the source timeout to the context", func() {
+		_, err := runResource(CheckType, `{"source": {"timeout": "1m"}}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(resource.deadline).Should(BeTrue())
+	})
+	It("passes the merged params with their defaults", func() {
+		response, err := runResource(InType, `{
+			"source": {
+				"params_schema": { "region": { "default": "eu-west-1" } },
+				"smuggler_params": { "a": "source" }
+			},
+			"version": {"ID": "1"},
+			"params": { "b": "params" }
+		}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Version).Should(Equal(Version{"ID": "1"}))
+		Ω(response.Metadata).Should(Equal([]MetadataPair{{Name: "dir", Value: "/some/path"}}))
+		Ω(resource.params).Should(Equal(map[string]interface{}{
+			"region": "eu-west-1", "a": "source", "b": "params",
+		}))
+	})
+	It("fails without calling the resource if the params do not match the params_schema", func() {
+		_, err := runResource(OutType, `{
+			"source": { "params_schema": { "bucket": { "required": true } } }
+		}`)
+		Ω(err).Should(BeAssignableToTypeOf(&ParamsError{}))
+	})
+	It("returns the response from Out", func() {
+		response, err := runResource(OutType, `{"source": {}}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Version).Should(Equal(Version{"ID": "out"}))
+	})
+})
+
+var _ = Describe("ContextLogger", func() {
+	It("returns a logger even if there is none in the context", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		Ω(ContextLogger(ctx)).ShouldNot(BeNil())
+	})
+})
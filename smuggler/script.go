@@ -0,0 +1,448 @@
+package smuggler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// Interpreter of the inline scripts of the commands
+type ScriptEngine string
+
+const (
+	// Starlark, a dialect of Python. See https://github.com/bazelbuild/starlark
+	ScriptEngineStarlark ScriptEngine = "starlark"
+)
+
+var scriptEngines = []string{string(ScriptEngineStarlark)}
+
+// Scripts are run like the shell ones, top to bottom, so they can loop
+// and branch out of functions
+var scriptFileOptions = &syntax.FileOptions{
+	Set:             true,
+	While:           true,
+	TopLevelControl: true,
+	GlobalReassign:  true,
+	Recursion:       true,
+}
+
+// Keys of the command environment which do not apply to scripts, as they
+// run in the smuggler process
+var scriptUnsupportedKeys = []string{"path", "args", "user", "uid", "gid", "umask"}
+
+func NewScriptEngine(s string) (ScriptEngine, error) {
+	switch e := ScriptEngine(s); e {
+	case ScriptEngineStarlark:
+		return e, nil
+	default:
+		return "", fmt.Errorf("invalid engine '%s', must be one of: %s", s, strings.Join(scriptEngines, ", "))
+	}
+}
+
+// Response reported by a script with add_version and add_metadata
+type scriptResponse struct {
+	versions []Version
+	metadata []MetadataPair
+	reported bool
+}
+
+// Runs the script of the command in the smuggler process. The versions and
+// metadata reported by the script are written as the JSON response in its
+// output, unless it only reports metadata for in or out, which is written
+// in the output dir so the version of the request is kept.
+func (command *SmugglerCommand) runScript(commandDefinition CommandDefinition, params map[string]interface{}, jsonRequest []byte) error {
+	command.lastCommand = nil
+	command.ranScript = true
+	command.scriptErr = nil
+	command.timedOut = false
+
+	if _, err := NewScriptEngine(commandDefinition.Engine); err != nil {
+		command.scriptErr = err
+		return err
+	}
+	timeout, _, err := commandDefinition.Timeouts()
+	if err != nil {
+		command.scriptErr = err
+		return err
+	}
+
+	paramsEnv := commandDefinition.environment(params, nil)
+	command.lastEnv = paramsEnv
+	env := make(map[string]string, len(paramsEnv))
+	for _, kv := range paramsEnv {
+		s := strings.SplitN(kv, "=", 2)
+		env[s[0]] = s[1]
+	}
+
+	command.logger.Printf(
+		"[INFO] Running %s script:\n\tDir: '%s'\n\tEnv:\n\t'%s'\n\tScript:\n%s",
+		commandDefinition.Engine, commandDefinition.Dir, strings.Join(paramsEnv, "',\n\t'"), commandDefinition.Script,
+	)
+
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	_, stderrWriter, echoWriters := command.outputWriters(stdout, stderr)
+
+	ctx := context.Background()
+	var cancel context.CancelFunc = func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	response := &scriptResponse{}
+	thread := &starlark.Thread{
+		Name: "smuggler",
+		Print: func(_ *starlark.Thread, msg string) {
+			fmt.Fprintln(stderrWriter, msg)
+		},
+	}
+	var timedOut int32
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			thread.Cancel(fmt.Sprintf("timed out after %s", timeout))
+		})
+		defer timer.Stop()
+	}
+
+	predeclared, err := scriptPredeclared(ctx, commandDefinition, params, env, jsonRequest, response)
+	if err == nil {
+		_, err = starlark.ExecFileOptions(scriptFileOptions, thread, "script", commandDefinition.Script, predeclared)
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			fmt.Fprintln(stderrWriter, evalErr.Backtrace())
+		}
+	}
+	if atomic.LoadInt32(&timedOut) == 1 {
+		command.timedOut = true
+		command.logger.Printf("[WARN] Script timed out after %s", timeout)
+		err = &CommandTimeoutError{Timeout: timeout}
+	}
+	if err == nil && response.reported {
+		outputDir, _ := params[smugglerVariable("OUTPUT_DIR")].(string)
+		action, _ := params[smugglerVariable("ACTION")].(string)
+		err = response.write(stdout, outputDir, RequestType(action))
+	}
+	for _, w := range echoWriters {
+		w.Flush()
+	}
+
+	command.scriptErr = err
+	command.LastCommandOutput, _ = ioutil.ReadAll(stdout)
+	command.LastCommandErr, _ = ioutil.ReadAll(stderr)
+	command.logger.Printf("[INFO] Output '%s'", command.LastCommandOutput)
+	command.logger.Printf("[INFO] Stderr '%s'", command.LastCommandErr)
+	command.logger.Printf("[INFO] Return error '%v'", err)
+	return err
+}
+
+// Writes the response as JSON in the output, or only the metadata in the
+// output dir if in or out do not report any version
+func (response *scriptResponse) write(stdout io.Writer, outputDir string, action RequestType) error {
+	metadata := response.metadata
+	if metadata == nil {
+		metadata = []MetadataPair{}
+	}
+	var v interface{}
+	switch {
+	case action == CheckType:
+		versions := response.versions
+		if versions == nil {
+			versions = []Version{}
+		}
+		v = versions
+	case len(response.versions) > 0:
+		v = ResourceResponse{Version: response.versions[len(response.versions)-1], Metadata: metadata}
+	default:
+		b, err := json.Marshal(metadata)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filepath.Join(outputDir, "metadata.json"), b, 0644)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = stdout.Write(b)
+	return err
+}
+
+// Returns the built-ins of the scripts:
+//
+//   - action: check, in or out.
+//   - request: the JSON request, as the commands read it from stdin.
+//   - version: the version of the request.
+//   - params: the params and the variables of smuggler, by variable name.
+//   - getenv(name, default=""): a variable of the environment of the command.
+//   - add_version(version): reports a version, a dict or an ID.
+//   - add_metadata(name, value): reports metadata for in and out.
+//   - http_request(url, method="GET", body="", headers={}): returns a
+//     struct with the status, body and headers of the response.
+//   - read_file(path), write_file(path, content), list_dir(path): relative
+//     to the dir of the command.
+//   - json: the encode, decode and indent functions.
+func scriptPredeclared(ctx context.Context, commandDefinition CommandDefinition, params map[string]interface{}, env map[string]string, jsonRequest []byte, response *scriptResponse) (starlark.StringDict, error) {
+	var request map[string]interface{}
+	if err := json.Unmarshal(jsonRequest, &request); err != nil {
+		return nil, err
+	}
+	version, _ := request["version"].(map[string]interface{})
+	if version == nil {
+		version = map[string]interface{}{}
+	}
+	action, _ := params[smugglerVariable("ACTION")].(string)
+
+	resolve := func(p string) string {
+		if filepath.IsAbs(p) || commandDefinition.Dir == "" {
+			return p
+		}
+		return filepath.Join(commandDefinition.Dir, p)
+	}
+
+	predeclared := starlark.StringDict{
+		"action":  starlark.String(action),
+		"request": toStarlark(request),
+		"version": toStarlark(version),
+		"params":  toStarlark(params),
+		"json":    starlarkjson.Module,
+		"getenv": starlark.NewBuiltin("getenv", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name, def string
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "default?", &def); err != nil {
+				return nil, err
+			}
+			if v, ok := env[name]; ok {
+				return starlark.String(v), nil
+			}
+			return starlark.String(def), nil
+		}),
+		"add_version": starlark.NewBuiltin("add_version", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var v starlark.Value
+			if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &v); err != nil {
+				return nil, err
+			}
+			version, err := versionFromStarlark(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+			}
+			response.versions = append(response.versions, version)
+			response.reported = true
+			return starlark.None, nil
+		}),
+		"add_metadata": starlark.NewBuiltin("add_metadata", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var name string
+			var value starlark.Value
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "name", &name, "value", &value); err != nil {
+				return nil, err
+			}
+			v, err := fromStarlark(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", fn.Name(), err)
+			}
+			response.metadata = append(response.metadata, MetadataPair{Name: name, Value: InterfaceToJsonString(v)})
+			response.reported = true
+			return starlark.None, nil
+		}),
+		"http_request": starlark.NewBuiltin("http_request", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var url, body string
+			method := "GET"
+			headers := &starlark.Dict{}
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "url", &url, "method?", &method, "body?", &body, "headers?", &headers); err != nil {
+				return nil, err
+			}
+			return scriptHttpRequest(ctx, method, url, body, headers)
+		}),
+		"read_file": starlark.NewBuiltin("read_file", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var p string
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &p); err != nil {
+				return nil, err
+			}
+			b, err := ioutil.ReadFile(resolve(p))
+			if err != nil {
+				return nil, err
+			}
+			return starlark.String(b), nil
+		}),
+		"write_file": starlark.NewBuiltin("write_file", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var p, content string
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &p, "content", &content); err != nil {
+				return nil, err
+			}
+			return starlark.None, ioutil.WriteFile(resolve(p), []byte(content), 0644)
+		}),
+		"list_dir": starlark.NewBuiltin("list_dir", func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var p string
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "path", &p); err != nil {
+				return nil, err
+			}
+			entries, err := ioutil.ReadDir(resolve(p))
+			if err != nil {
+				return nil, err
+			}
+			names := make([]starlark.Value, 0, len(entries))
+			for _, e := range entries {
+				names = append(names, starlark.String(e.Name()))
+			}
+			return starlark.NewList(names), nil
+		}),
+	}
+	return predeclared, nil
+}
+
+// Client of http_request. The requests also stop when the script times out.
+var scriptHttpClient = &http.Client{Timeout: 1 * time.Minute}
+
+func scriptHttpRequest(ctx context.Context, method string, url string, body string, headers *starlark.Dict) (starlark.Value, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range headers.Items() {
+		k, ok := starlark.AsString(item[0])
+		v, ok2 := starlark.AsString(item[1])
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("http_request: headers must be strings, got %s: %s", item[0].Type(), item[1].Type())
+		}
+		req.Header.Set(k, v)
+	}
+	resp, err := scriptHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	respHeaders := map[string]interface{}{}
+	for k := range resp.Header {
+		respHeaders[k] = resp.Header.Get(k)
+	}
+	return starlarkstruct.FromStringDict(starlark.String("response"), starlark.StringDict{
+		"status":  starlark.MakeInt(resp.StatusCode),
+		"body":    starlark.String(b),
+		"headers": toStarlark(respHeaders),
+	}), nil
+}
+
+// A version is a dict with the values by key, or the ID as a string
+func versionFromStarlark(v starlark.Value) (Version, error) {
+	if s, ok := starlark.AsString(v); ok {
+		return *NewVersion(s), nil
+	}
+	i, err := fromStarlark(v)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := i.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected dict or string, got %s", v.Type())
+	}
+	version := make(Version, len(m))
+	for k, e := range m {
+		if s, ok := e.(string); ok {
+			version[k] = s
+		} else {
+			version[k] = InterfaceToJsonString(e)
+		}
+	}
+	return version, nil
+}
+
+// Converts a value decoded from JSON to starlark
+func toStarlark(v interface{}) starlark.Value {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None
+	case bool:
+		return starlark.Bool(v)
+	case string:
+		return starlark.String(v)
+	case int:
+		return starlark.MakeInt(v)
+	case float64:
+		if v == float64(int64(v)) {
+			return starlark.MakeInt64(int64(v))
+		}
+		return starlark.Float(v)
+	case []interface{}:
+		l := make([]starlark.Value, 0, len(v))
+		for _, e := range v {
+			l = append(l, toStarlark(e))
+		}
+		return starlark.NewList(l)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := starlark.NewDict(len(v))
+		for _, k := range keys {
+			d.SetKey(starlark.String(k), toStarlark(v[k]))
+		}
+		return d
+	default:
+		return starlark.String(InterfaceToJsonString(v))
+	}
+}
+
+// Converts a starlark value to the types decoded from JSON
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("integer out of range: %s", v)
+		}
+		return float64(i), nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.Indexable:
+		l := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			e, err := fromStarlark(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, e)
+		}
+		return l, nil
+	case *starlark.Dict:
+		m := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, got %s", item[0].Type())
+			}
+			e, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			m[k] = e
+		}
+		return m, nil
+	default:
+		return nil, fmt.Errorf("unsupported type %s", v.Type())
+	}
+}
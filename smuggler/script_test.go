@@ -0,0 +1,123 @@
+package smuggler_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"go.starlark.net/resolve"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+var _ = Describe("SmugglerCommand scripts", func() {
+	runScript := func(requestType RequestType, script string, extra string) {
+		request, err = NewResourceRequest(requestType, fmt.Sprintf(`{
+			"source": {
+				"commands": {
+					"%s": { "engine": "starlark", "script": %q %s }
+				}
+			}
+		}`, requestType, script, extra))
+		Ω(err).ShouldNot(HaveOccurred())
+		command = NewSmugglerCommand(logger)
+		response, err = command.RunAction("", request)
+	}
+
+	It("reports the versions of check without running any process", func() {
+		runCommandFromFixture(CheckType, "", "starlark_script", "2")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(command.LastCommand()).Should(BeNil())
+		Ω(command.LastCommandSuccess()).Should(BeTrue())
+		Ω(string(command.LastCommandErr)).Should(Equal("checking my-bucket\n"))
+		Ω(response.Versions).Should(Equal([]Version{
+			{"ID": "2", "bucket": "my-bucket"},
+			{"ID": "3", "bucket": "my-bucket"},
+			{"ID": "4", "bucket": "my-bucket"},
+		}))
+	})
+
+	It("writes files and reports metadata keeping the version of in", func() {
+		dataDir, err = ioutil.TempDir("", "starlark-script")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		runCommandFromFixture(InType, dataDir, "starlark_script", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		content, readErr := ioutil.ReadFile(filepath.Join(dataDir, "version.json"))
+		Ω(readErr).ShouldNot(HaveOccurred())
+		Ω(string(content)).Should(Equal(`{"ID":"1.2.3"}`))
+		Ω(response.Version).Should(Equal(*NewVersion("1.2.3")))
+		Ω(response.Metadata).Should(Equal([]MetadataPair{{Name: "files", Value: `["version.json"]`}}))
+	})
+
+	It("reports the version and metadata of out", func() {
+		runCommandFromFixture(OutType, "/some/path", "starlark_script", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Version).Should(Equal(*NewVersion("4.5.6")))
+		Ω(response.Metadata).Should(Equal([]MetadataPair{{Name: "action", Value: "out"}}))
+	})
+
+	It("calls HTTP endpoints", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `[{"ref": "%s"}, {"ref": "b"}]`, r.Header.Get("X-Ref"))
+		}))
+		defer server.Close()
+
+		runScript(CheckType, fmt.Sprintf(`
+resp = http_request(%q, headers={"X-Ref": "a"})
+if resp.status != 200:
+    fail("unexpected status %%d" %% resp.status)
+for v in json.decode(resp.body):
+    add_version(v)
+`, server.URL), "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{{"ref": "a"}, {"ref": "b"}}))
+	})
+
+	It("runs loops at the top level without changing the global options of starlark", func() {
+		runScript(CheckType, "n = 0\nwhile n < 3:\n    n += 1\nadd_version(str(n))\n", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("3")}))
+		Ω(resolve.AllowGlobalReassign).Should(BeFalse())
+		Ω(resolve.AllowRecursion).Should(BeFalse())
+		Ω(resolve.AllowSet).Should(BeFalse())
+	})
+
+	It("fails with the error of the script", func() {
+		runScript(CheckType, `fail("no versions")`, "")
+		Ω(err).Should(MatchError(ContainSubstring("no versions")))
+		Ω(command.LastCommandSuccess()).Should(BeFalse())
+		Ω(command.LastCommandExitStatus()).Should(Equal(1))
+		Ω(string(command.LastCommandErr)).Should(ContainSubstring("script:1:"))
+	})
+
+	It("retries the failed scripts", func() {
+		attemptsDir, tempErr := ioutil.TempDir("", "starlark-attempts")
+		Ω(tempErr).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(attemptsDir)
+
+		runScript(CheckType, fmt.Sprintf(`
+attempts = len(list_dir(%q))
+write_file(%q + "/" + str(attempts), "")
+if attempts < 2:
+    fail("attempt %%d" %% attempts)
+add_version("ok")
+`, attemptsDir, attemptsDir), `, "retries": 2, "backoff": "1ms"`)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("ok")}))
+	})
+
+	It("stops the script when it times out", func() {
+		runScript(CheckType, "while True:\n    pass\n", `, "timeout": "100ms"`)
+		Ω(err).Should(MatchError("command timed out after 100ms"))
+		Ω(command.LastCommandTimedOut()).Should(BeTrue())
+		Ω(command.LastCommandExitStatus()).Should(Equal(TimeoutExitStatus))
+	})
+})
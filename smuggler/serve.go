@@ -0,0 +1,229 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+)
+
+// Determine which command is being called by the name
+func ProcessArguments() (string, RequestType) {
+	var dataDir string
+
+	commandName := filepath.Base(os.Args[0])
+	requestType, ok := requestTypeFromCommandName(commandName)
+	switch {
+	case !ok:
+		utils.Panic("identifying resource type: command name '%s' does not contain check/in/out", commandName)
+	case requestType == InType:
+		if len(os.Args) < 2 {
+			utils.Sayf("usage: %s <dest directory>\n", os.Args[0])
+			os.Exit(1)
+		}
+		dataDir = os.Args[1]
+	case requestType == OutType:
+		if len(os.Args) < 2 {
+			utils.Sayf("usage: %s <sources directory>\n", os.Args[0])
+			os.Exit(1)
+		}
+		dataDir = os.Args[1]
+	}
+
+	return dataDir, requestType
+}
+
+func requestTypeFromCommandName(commandName string) (RequestType, bool) {
+	switch {
+	case strings.Contains(commandName, "check"):
+		return CheckType, true
+	case strings.Contains(commandName, "in"):
+		return InType, true
+	case strings.Contains(commandName, "out"):
+		return OutType, true
+	}
+	return "", false
+}
+
+func OpenSmugglerLog() *utils.TempFileLogger {
+	// Open Log file
+	smugglerLogFileName := utils.GetEnvOrDefault("SMUGGLER_LOG", "/tmp/smuggler.log")
+	tempFileLogger, err := utils.NewTempFileLogger(smugglerLogFileName)
+	if err != nil {
+		utils.Panic("opening log '%s': %s", smugglerLogFileName, err.Error())
+	}
+	return tempFileLogger
+}
+
+// Read input request, merged with the configuration file
+func InputRequest(requestType RequestType, logger *log.Logger) (*ResourceRequest, []byte) {
+	input, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		utils.Panic("reading request from stdin: %s", err.Error())
+	}
+
+	smugglerConfig := FindAndReadSmugglerConfig(logger)
+
+	r := ParseInputAndConfig(requestType, input, smugglerConfig)
+
+	return r, input
+}
+
+// Parses the request, merged with the smuggler configuration if any
+func ParseInputAndConfig(requestType RequestType, input []byte, config *SmugglerConfig) *ResourceRequest {
+	var requestCatchAll struct {
+		Source  map[string]interface{} `json:"source,omitempty"`
+		Version map[string]interface{} `json:"version,omitempty"`
+		Params  map[string]interface{} `json:"params,omitempty"`
+	}
+
+	// The errors might contain the secrets of the request
+	masker := requestSecretMasker(requestType, input, &SecretMasker{})
+
+	err := json.Unmarshal(input, &requestCatchAll)
+	if err != nil {
+		utils.Panic("Error parsing request: %s", masker.MaskError(err))
+	}
+	err = ValidateRequest(requestCatchAll.Source, requestCatchAll.Version, requestCatchAll.Params)
+	if err != nil {
+		utils.Panic("Error in request: %s", masker.MaskError(err))
+	}
+
+	var origins ConfigOrigins
+	if config != nil {
+		// The profile of the pipeline, or the default one of the configuration
+		profile, ok := requestCatchAll.Source["profile"].(string)
+		if !ok {
+			profile, _ = config.Values["profile"].(string)
+		}
+		config, err = config.WithProfile(profile)
+		if err != nil {
+			utils.Panic("Error in 'source.profile': %s", masker.MaskError(err))
+		}
+
+		origins = config.Origins.copy()
+		requestCatchAll.Source, err = mergeConfig(config.Values, requestCatchAll.Source, OriginPipeline, config.Strategies, origins)
+		if err != nil {
+			utils.Panic("Error merging the smuggler configuration: %s", masker.MaskError(err))
+		}
+		input, err = json.Marshal(&requestCatchAll)
+		if err != nil {
+			utils.Panic("Error merging the smuggler configuration: %s", masker.MaskError(err))
+		}
+		// smuggler.yml might declare more secrets
+		masker = requestSecretMasker(requestType, input, masker)
+
+		// Valid values of the pipeline and smuggler.yml might not be valid
+		// once merged, like a value of a different type appended to a list
+		err = ValidateRequest(requestCatchAll.Source, nil, nil)
+		if err != nil {
+			utils.Panic("Error in request merged with the smuggler configuration: %s", masker.MaskError(err))
+		}
+	}
+	request, err := NewResourceRequest(requestType, string(input))
+	if err != nil {
+		utils.Panic("Error parsing request from stdin: %s", masker.MaskError(err))
+	}
+	request.ConfigOrigins = origins
+	request.ValidationWarnings = sourceKeyWarnings("source", requestCatchAll.Source, sourceSchema)
+	return request
+}
+
+// Returns the masker of the secrets of the request, or the given one if it
+// cannot be parsed
+func requestSecretMasker(requestType RequestType, input []byte, fallback *SecretMasker) *SecretMasker {
+	request, err := NewResourceRequest(requestType, string(input))
+	if err != nil {
+		return fallback
+	}
+	return NewSecretMasker(request)
+}
+
+// Reads the smuggler configuration from its files, or returns nil if
+// there is none
+func FindAndReadSmugglerConfig(logger *log.Logger) *SmugglerConfig {
+	paths := FindSmugglerConfigPaths(logger)
+	if len(paths) == 0 {
+		return nil
+	}
+	logger.Printf("[INFO] Found config files: %s", strings.Join(paths, ", "))
+
+	config, err := ReadSmugglerConfig(paths)
+	if err != nil {
+		utils.Panic("Error in the smuggler configuration: %s", err)
+	}
+	return config
+}
+
+// Runs the action of the request, echoing the output of the commands to
+// stderr, and sends back the response. Exits with the exit status of the
+// command if it fails.
+func RunRequest(dataDir string, request *ResourceRequest, jsonRequest []byte, tempFileLogger *utils.TempFileLogger) {
+	// Dump logs to stderr if required
+	if request.Source.SmugglerDebug {
+		tempFileLogger.DupToStderr()
+	}
+
+	// Do not leak the secrets in the logs, nor in the errors
+	masker := NewSecretMasker(request)
+	logger := masker.WrapLogger(tempFileLogger.Logger)
+
+	// Execute command, echoing its output to stderr as it runs
+	outputMode, err := NewOutputMode(request.Source.OutputMode)
+	if err != nil {
+		utils.Panic("Error in 'source.output_mode': %s", masker.MaskError(err))
+	}
+
+	command := NewSmugglerCommand(logger)
+	command.StreamOutputTo(os.Stderr, outputMode)
+
+	logger.Printf(
+		"[INFO] Smuggler command called as:\n%s <<\"EOF\"\n%s\nEOF",
+		strings.Join(os.Args, " "),
+		utils.JsonPrettyPrint(jsonRequest),
+	)
+
+	if len(request.ConfigOrigins) > 0 {
+		logger.Printf("[DEBUG] Origin of the configuration values:\n%s", request.ConfigOrigins)
+	}
+	for _, warning := range request.ValidationWarnings {
+		logger.Printf("[WARN] %s", warning)
+	}
+
+	response, err := command.RunAction(dataDir, request)
+	if replayDir := request.Source.ReplayDirectory(); replayDir != "" {
+		bundle := NewReplayBundle(dataDir, request, jsonRequest, command.LastCommandEnv())
+		bundle.SetResult(response, err, command.LastCommandExitStatus())
+		writeReplayBundle(bundle, replayDir, logger)
+	}
+	if err != nil {
+		utils.Fatal("running command", masker.MaskError(err), command.LastCommandExitStatus())
+	}
+
+	OutputResponse(response)
+}
+
+// Send back response
+func OutputResponse(response *ResourceResponse) {
+	if response.Type == CheckType {
+		outputResponseCheck(response.Versions)
+	} else {
+		outputResponseInOut(response)
+	}
+}
+
+func outputResponseCheck(response []Version) {
+	if err := json.NewEncoder(os.Stdout).Encode(response); err != nil {
+		utils.Panic("writing response to stdout: %s", err)
+	}
+}
+
+func outputResponseInOut(response *ResourceResponse) {
+	if err := json.NewEncoder(os.Stdout).Encode(response); err != nil {
+		utils.Panic("writing response to stdout: %s", err)
+	}
+}
@@ -4,18 +4,42 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
+// Exit status reported when a command is killed because it timed out,
+// same as timeout(1)
+const TimeoutExitStatus = 124
+
+type CommandTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *CommandTimeoutError) Error() string {
+	return fmt.Sprintf("command timed out after %s", e.Timeout)
+}
+
 type SmugglerCommand struct {
 	lastCommand       *exec.Cmd
+	lastEnv           []string
 	logger            *log.Logger
+	output            io.Writer
+	outputMode        OutputMode
+	masker            *SecretMasker
+	timedOut          bool
+	umask             int
+	ranScript         bool
+	scriptErr         error
 	LastCommandOutput []byte
 	LastCommandErr    []byte
 }
@@ -24,50 +48,110 @@ func NewSmugglerCommand(logger *log.Logger) *SmugglerCommand {
 	return &SmugglerCommand{logger: logger}
 }
 
+// Echo the stdout and stderr of the commands to the given writer while
+// they run, as defined by the output mode.
+func (command *SmugglerCommand) StreamOutputTo(w io.Writer, mode OutputMode) {
+	command.output = w
+	command.outputMode = mode
+}
+
 func (command *SmugglerCommand) LastCommand() *exec.Cmd {
 	return command.lastCommand
 }
 
+// Environment the last command ran with, or nil if no command ran
+func (command *SmugglerCommand) LastCommandEnv() []string {
+	return command.lastEnv
+}
+
 func (command *SmugglerCommand) LastCommandSuccess() bool {
+	if command.ranScript {
+		return !command.timedOut && command.scriptErr == nil
+	}
 	if command.lastCommand == nil || command.lastCommand.ProcessState == nil {
 		return true
 	}
-	return command.lastCommand.ProcessState.Success()
+	return !command.timedOut && command.lastCommand.ProcessState.Success()
+}
+
+func (command *SmugglerCommand) LastCommandTimedOut() bool {
+	return command.timedOut
 }
 
 func (command *SmugglerCommand) LastCommandExitStatus() int {
+	if command.timedOut {
+		return TimeoutExitStatus
+	}
+	// Scripts have no exit status, they either succeed or fail
+	if command.ranScript {
+		if command.scriptErr != nil {
+			return 1
+		}
+		return 0
+	}
+	// Failed before or while starting the command
+	if command.lastCommand == nil || command.lastCommand.ProcessState == nil {
+		return 1
+	}
 	waitStatus := command.lastCommand.ProcessState.Sys().(syscall.WaitStatus)
 	return waitStatus.ExitStatus()
 }
 
 func (command *SmugglerCommand) Run(commandDefinition CommandDefinition, params map[string]interface{}, jsonRequest []byte) error {
+	if commandDefinition.Engine != "" {
+		return command.runScript(commandDefinition, params, jsonRequest)
+	}
+	command.ranScript = false
+	command.scriptErr = nil
 
 	path := commandDefinition.Path
 	args := commandDefinition.Args
 
-	params_env := make([]string, 0, len(params))
-	for k, v := range params {
-		string_val := InterfaceToJsonString(v)
-		env_key_val := fmt.Sprintf("SMUGGLER_%s=%s", k, string_val)
-		params_env = append(params_env, env_key_val)
+	timeout, gracePeriod, err := commandDefinition.Timeouts()
+	if err != nil {
+		return err
+	}
+
+	credential, userEnv, err := commandDefinition.credential()
+	if err != nil {
+		return err
+	}
+	umask, err := commandDefinition.umask()
+	if err != nil {
+		return err
+	}
+	params_env := commandDefinition.environment(params, userEnv)
+	if err := chownCommandFiles(params, credential); err != nil {
+		return err
 	}
-	params_env = append(params_env, os.Environ()...)
 
 	command.logger.Printf(
-		"[INFO] Running command:\n\tPath: '%s'\n\tArgs: '%s'\n\tEnv:\n\t'%s'",
-		path, strings.Join(args, "' '"), strings.Join(params_env, "',\n\t'"),
+		"[INFO] Running command:\n\tPath: '%s'\n\tArgs: '%s'\n\tDir: '%s'\n\tEnv:\n\t'%s'",
+		path, strings.Join(args, "' '"), commandDefinition.Dir, strings.Join(params_env, "',\n\t'"),
 	)
 
 	command.lastCommand = exec.Command(path, args...)
 	command.lastCommand.Env = params_env
+	command.lastEnv = params_env
+	command.lastCommand.Dir = commandDefinition.Dir
+	command.lastCommand.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	command.umask = umask
+	command.timedOut = false
+	if timeout > 0 {
+		// Run in its own process group, so we can kill all its children
+		command.lastCommand.SysProcAttr.Setpgid = true
+	}
 
 	command.lastCommand.Stdin = bytes.NewBuffer(jsonRequest)
 	stdout := new(bytes.Buffer)
-	command.lastCommand.Stdout = stdout
 	stderr := new(bytes.Buffer)
-	command.lastCommand.Stderr = stderr
+	var echoWriters []*lineWriter
+	command.lastCommand.Stdout, command.lastCommand.Stderr, echoWriters = command.outputWriters(stdout, stderr)
 
-	err := command.lastCommand.Run()
+	err = command.runWithTimeout(timeout, gracePeriod)
+	for _, w := range echoWriters {
+		w.Flush()
+	}
 	command.LastCommandOutput, _ = ioutil.ReadAll(stdout)
 	command.LastCommandErr, _ = ioutil.ReadAll(stderr)
 	command.logger.Printf("[INFO] Output '%s'", command.LastCommandOutput)
@@ -77,61 +161,280 @@ func (command *SmugglerCommand) Run(commandDefinition CommandDefinition, params
 	return err
 }
 
+// Returns the writers for the stdout and stderr of a command, which echo
+// the output line by line as it is produced, and the echo writers to
+// flush when it finishes
+func (command *SmugglerCommand) outputWriters(stdout io.Writer, stderr io.Writer) (io.Writer, io.Writer, []*lineWriter) {
+	var echoWriters []*lineWriter
+	if command.output == nil {
+		return stdout, stderr, echoWriters
+	}
+	mutex := new(sync.Mutex)
+	mode := command.outputMode
+	output := command.masker.Writer(command.output)
+	if mode.echoStdout() {
+		w := newLineWriter(output, mutex, mode.prefix("stdout"))
+		stdout = io.MultiWriter(stdout, w)
+		echoWriters = append(echoWriters, w)
+	}
+	if mode.echoStderr() {
+		w := newLineWriter(output, mutex, mode.prefix("stderr"))
+		stderr = io.MultiWriter(stderr, w)
+		echoWriters = append(echoWriters, w)
+	}
+	return stdout, stderr, echoWriters
+}
+
+// Starts the last command with its umask. The umask is of the process, so
+// it is only changed while the command is started.
+func (command *SmugglerCommand) start() error {
+	if command.umask < 0 {
+		return command.lastCommand.Start()
+	}
+	previous := syscall.Umask(command.umask)
+	defer syscall.Umask(previous)
+	return command.lastCommand.Start()
+}
+
+// Runs the last command. If it does not finish before the timeout, sends
+// SIGTERM to its process group, and SIGKILL after the grace period.
+func (command *SmugglerCommand) runWithTimeout(timeout time.Duration, gracePeriod time.Duration) error {
+	cmd := command.lastCommand
+	if err := command.start(); err != nil {
+		return err
+	}
+	if timeout <= 0 {
+		return cmd.Wait()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+	}
+
+	command.timedOut = true
+	command.logger.Printf("[WARN] Command timed out after %s, sending SIGTERM", timeout)
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(gracePeriod):
+		command.logger.Printf("[WARN] Command still running after %s, sending SIGKILL", gracePeriod)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+	}
+	return &CommandTimeoutError{Timeout: timeout}
+}
+
 func (command *SmugglerCommand) RunAction(dataDir string, request *ResourceRequest) (*ResourceResponse, error) {
+	// Do not leak the secrets in the logs or in the output
+	command.masker = NewSecretMasker(request)
+	logger := command.logger
+	command.logger = command.masker.WrapLogger(logger)
+	defer func() { command.logger = logger }()
+
 	command.logger.Printf("[INFO] Running %s action", string(request.Type))
 
+	if request.Source.Templating {
+		rendered, err := request.RenderTemplates()
+		if err != nil {
+			return &ResourceResponse{Type: request.Type}, err
+		}
+		request = rendered
+	}
+
+	if request.Type == CheckType && request.Source.CheckCache != nil {
+		return command.runCachedCheck(dataDir, request)
+	}
+	return command.runAction(dataDir, request)
+}
+
+// Runs the command of the action with its hooks
+func (command *SmugglerCommand) runAction(dataDir string, request *ResourceRequest) (*ResourceResponse, error) {
 	var response = ResourceResponse{
 		Type: request.Type,
 	}
 
-	commandDefinition, err := request.Source.FindCommand(string(request.Type))
+	err := command.runHooks(PreHook, dataDir, request, nil)
+	if err == nil {
+		err = command.runActionCommand(dataDir, request, &response)
+	}
+	// The version is stored before the post hooks, which only run if out
+	// fully succeeded
+	if err == nil && request.Type == OutType && request.Source.VersionStore != nil {
+		err = command.putVersionStore(request, &response)
+	}
+	if err == nil {
+		err = command.runPostHooks(dataDir, request, &response)
+	}
 	if err != nil {
+		command.runFailureHooks(dataDir, request, err)
 		return &response, err
 	}
 
+	return &response, nil
+}
+
+// Runs the command of the action, retrying it if it fails
+func (command *SmugglerCommand) runActionCommand(dataDir string, request *ResourceRequest, response *ResourceResponse) error {
+	commandDefinition, err := request.Source.FindCommand(string(request.Type))
+	if err != nil {
+		return err
+	}
+
+	runAttempt := command.runActionAttempt
+	if commandDefinition == nil && request.Source.Wrap != nil {
+		command.logger.Printf("[INFO] No command definition, calling the wrapped resource")
+		commandDefinition = request.Source.WrappedCommand(request.Type, dataDir)
+		runAttempt = command.runWrappedAttempt
+	}
+
+	if commandDefinition == nil && request.Type == CheckType && request.Source.VersionStore != nil {
+		command.logger.Printf("[INFO] No command definition, reporting the versions of the version store")
+		if err := command.checkVersionStore(request, response); err != nil {
+			return err
+		}
+		if err := command.processVersions(request, response); err != nil {
+			return err
+		}
+		command.logger.Printf("[INFO] version store reports versions '%q'", response.Versions)
+		return nil
+	}
 	if commandDefinition == nil {
 		command.logger.Printf("[INFO] No command definition, skipping")
-		return &response, nil
+		// The versions of the store do not need to be fetched
+		if request.Type == InType && request.Source.VersionStore != nil {
+			response.Version = request.Version
+		}
+		useDefaultVersion(request, response)
+		return nil
 	}
 
+	initialDelay, maxDelay, err := commandDefinition.Backoffs()
+	if err != nil {
+		return err
+	}
+	delay := initialDelay
+	attempts := commandDefinition.Retries + 1
+	for attempt := 1; ; attempt++ {
+		if attempts > 1 {
+			command.logger.Printf("[INFO] Attempt %d of %d", attempt, attempts)
+		}
+		// Only the response of the last attempt is kept
+		*response = ResourceResponse{
+			Type: request.Type,
+		}
+		err = runAttempt(*commandDefinition, dataDir, request, response)
+		if err == nil || attempt >= attempts || !command.shouldRetry(*commandDefinition) {
+			break
+		}
+		command.logger.Printf("[WARN] Attempt %d of %d failed: %s. Retrying in %s", attempt, attempts, err, delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if request.Type == CheckType {
+		if err := command.processVersions(request, response); err != nil {
+			return err
+		}
+	}
+
+	command.logger.Printf("[INFO] command reports versions '%q'", response.Versions)
+	command.logger.Printf("[INFO] command reports metadata '%q'", response.Metadata)
+
+	return nil
+}
+
+// Deduplicates, filters and sorts the versions reported by check
+func (command *SmugglerCommand) processVersions(request *ResourceRequest, response *ResourceResponse) error {
+	versions, discarded, err := request.Source.ProcessVersions(request.Version, response.Versions)
+	if err != nil {
+		return err
+	}
+	if len(discarded) > 0 {
+		command.logger.Printf("[WARN] Discarded versions which cannot be sorted by '%s': '%q'", request.Source.VersionOrder, discarded)
+	}
+	response.Versions = versions
+	useDefaultVersion(request, response)
+	return nil
+}
+
+// Retry only if the command did run and failed with one of the exit
+// codes to retry on
+func (command *SmugglerCommand) shouldRetry(commandDefinition CommandDefinition) bool {
+	if !command.ranScript && (command.lastCommand == nil || command.lastCommand.ProcessState == nil) {
+		return false
+	}
+	if command.LastCommandSuccess() {
+		return false
+	}
+	return commandDefinition.RetriesOnExitStatus(command.LastCommandExitStatus())
+}
+
+func (command *SmugglerCommand) runActionAttempt(commandDefinition CommandDefinition, dataDir string, request *ResourceRequest, response *ResourceResponse) error {
 	outputDir, err := ioutil.TempDir("", "smuggler-run")
 	if err != nil {
-		return &response, err
+		return err
 	}
 	defer os.RemoveAll(outputDir)
 
 	params, err := prepareParams(dataDir, outputDir, request)
 	if err != nil {
-		return &response, err
+		return err
 	}
 
 	jsonRequest, err := prepareJsonRequest(request)
 	if err != nil {
-		return &response, err
+		return err
 	}
 
-	err = command.Run(*commandDefinition, params, jsonRequest)
+	err = command.Run(commandDefinition, params, jsonRequest)
 	if err != nil {
-		return &response, err
+		return err
 	}
 
 	// Try to get the response from a valid json from Stdout.
 	// If not, as files from the output directory
-	err = populateResponseFromStdoutAsJson(command.LastCommandOutput, request, &response)
+	err = populateResponseFromStdoutAsJson(command.LastCommandOutput, request, response)
 	if err != nil {
-		err = populateResponseFromOutputDir(outputDir, request, &response)
+		err = populateResponseFromOutputDir(outputDir, request, response)
 		if err != nil {
-			return &response, err
+			return err
 		}
 	} else {
 		// Empty the output buffer
 		command.LastCommandOutput = []byte{}
 	}
+	useDefaultVersion(request, response)
+	return nil
+}
 
-	command.logger.Printf("[INFO] command reports versions '%q'", response.Versions)
-	command.logger.Printf("[INFO] command reports metadata '%q'", response.Metadata)
-
-	return &response, nil
+// Report the default version if the action did not report any
+func useDefaultVersion(request *ResourceRequest, response *ResourceResponse) {
+	defaultVersion := request.Source.DefaultVersion(response.Type)
+	if defaultVersion == nil {
+		return
+	}
+	switch response.Type {
+	case CheckType:
+		if len(response.Versions) == 0 {
+			response.Versions = []Version{*defaultVersion}
+		}
+	case InType:
+		if len(response.Version) == 0 {
+			response.Version = *defaultVersion
+		}
+	}
 }
 
 func copyMaps(maps ...map[string]interface{}) map[string]interface{} {
@@ -148,31 +451,34 @@ func copyMaps(maps ...map[string]interface{}) map[string]interface{} {
 	return result
 }
 
+// Returns the variables for the commands, by name: the params and the
+// variables set by smuggler
 func prepareParams(dataDir string, outputDir string, request *ResourceRequest) (map[string]interface{}, error) {
-	// Prepare the params to send to the commands
-	params := copyMaps(
-		request.Source.SmugglerParams,
-		request.Source.ExtraParams,
-		request.Params.SmugglerParams,
-		request.Params.ExtraParams,
-	)
-	params["ACTION"] = string(request.Type)
-	params["COMMAND"] = string(request.Type)
-	params["OUTPUT_DIR"] = outputDir
+	params, err := request.AllParams()
+	if err != nil {
+		return nil, err
+	}
+	env, err := request.Source.paramsEnv(params)
+	if err != nil {
+		return nil, err
+	}
+	env[smugglerVariable("ACTION")] = string(request.Type)
+	env[smugglerVariable("COMMAND")] = string(request.Type)
+	env[smugglerVariable("OUTPUT_DIR")] = outputDir
 	switch request.Type {
 	case "check", "in":
 		for k, v := range request.Version {
-			params[fmt.Sprintf("VERSION_%s", k)] = v
+			env[smugglerVariable(fmt.Sprintf("VERSION_%s", k))] = v
 		}
 	}
 	switch request.Type {
 	case "in":
-		params["DESTINATION_DIR"] = dataDir
+		env[smugglerVariable("DESTINATION_DIR")] = dataDir
 	case "out":
-		params["SOURCES_DIR"] = dataDir
+		env[smugglerVariable("SOURCES_DIR")] = dataDir
 	}
 
-	return params, nil
+	return env, nil
 }
 
 func prepareJsonRequest(request *ResourceRequest) ([]byte, error) {
@@ -213,7 +519,7 @@ func populateResponseFromStdoutAsJson(stdout []byte, request *ResourceRequest, r
 // Tries to get the Request from the filesystem
 //
 func populateResponseFromOutputDir(outputDir string, request *ResourceRequest, response *ResourceResponse) error {
-	versions, err := readVersions(filepath.Join(outputDir, "versions"))
+	versions, err := readVersions(filepath.Join(outputDir, "versions"), request.Source.VersionsFormat)
 	if err != nil {
 		return err
 	}
@@ -222,6 +528,11 @@ func populateResponseFromOutputDir(outputDir string, request *ResourceRequest, r
 	if err != nil {
 		return err
 	}
+	jsonMetadata, err := readMetadataJson(filepath.Join(outputDir, "metadata.json"))
+	if err != nil {
+		return err
+	}
+	metadata = append(metadata, jsonMetadata...)
 
 	switch response.Type {
 	case "check":
@@ -229,6 +540,8 @@ func populateResponseFromOutputDir(outputDir string, request *ResourceRequest, r
 	case "in", "out":
 		if len(versions) > 0 {
 			response.Version = versions[0]
+		} else if defaultVersion := request.Source.DefaultVersion(response.Type); defaultVersion != nil {
+			response.Version = *defaultVersion
 		} else {
 			response.Version = request.Version
 		}
@@ -238,54 +551,134 @@ func populateResponseFromOutputDir(outputDir string, request *ResourceRequest, r
 	return nil
 }
 
-func readVersions(versionsFile string) ([]Version, error) {
-	result := []Version{}
-
-	result = make([]Version, 0)
-	if versionLines, err := readAndTrimAllLines(versionsFile); err != nil {
+func readVersions(versionsFile string, format string) ([]Version, error) {
+	result := make([]Version, 0)
+	versionsFormat, err := NewVersionsFormat(format)
+	if err != nil {
 		return result, err
-	} else {
-		for _, l := range versionLines {
-			result = append(result, *NewVersion(l))
+	}
+	if _, err := os.Stat(versionsFile); os.IsNotExist(err) {
+		return result, nil
+	}
+	content, err := ioutil.ReadFile(versionsFile)
+	if err != nil {
+		return result, err
+	}
+	for n, l := range strings.Split(string(content), "\n") {
+		// Do not trim the tabs separating the fields
+		if versionsFormat == VersionsFormatTsv {
+			l = strings.Trim(l, " ")
+		} else {
+			l = strings.Trim(l, "\t ")
+		}
+		if strings.Trim(l, "\t") == "" {
+			continue
 		}
+		v, err := NewVersionWithFormat(l, versionsFormat)
+		if err != nil {
+			return result, fmt.Errorf("versions line %d: %s", n+1, err)
+		}
+		result = append(result, *v)
 	}
 	return result, nil
 }
 
+// Reads the metadata lines, either as `key=value` or as a JSON object
+// `{"name": "key", "value": "value"}` per line
 func readMetadata(metadataFile string) ([]MetadataPair, error) {
 	result := []MetadataPair{}
-	if metadataLines, err := readAndTrimAllLines(metadataFile); err != nil {
+	if _, err := os.Stat(metadataFile); os.IsNotExist(err) {
+		return result, nil
+	}
+	content, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
 		return result, err
-	} else {
-		for _, l := range metadataLines {
-			s := strings.SplitN(l, "=", 2)
-			k, v := "", ""
-			k = strings.Trim(s[0], " \t")
-			if len(s) > 1 {
-				v = strings.Trim(s[1], " \t")
+	}
+	for n, l := range strings.Split(string(content), "\n") {
+		l = strings.Trim(l, "\t ")
+		if l == "" {
+			continue
+		}
+		if strings.HasPrefix(l, "{") {
+			var v interface{}
+			if err := json.Unmarshal([]byte(l), &v); err != nil {
+				return result, fmt.Errorf("metadata line %d: invalid JSON: %s", n+1, err)
+			}
+			pair, err := newMetadataPairFromInterface(v)
+			if err != nil {
+				return result, fmt.Errorf("metadata line %d: %s", n+1, err)
 			}
-			result = append(result, MetadataPair{Name: k, Value: v})
+			result = append(result, *pair)
+			continue
 		}
+		s := strings.SplitN(l, "=", 2)
+		k, v := "", ""
+		k = strings.Trim(s[0], " \t")
+		if len(s) > 1 {
+			v = strings.Trim(s[1], " \t")
+		}
+		result = append(result, MetadataPair{Name: k, Value: v})
 	}
 	return result, nil
 }
 
-func readAndTrimAllLines(filename string) ([]string, error) {
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return []string{}, nil
+// Reads the metadata as JSON, either a list of `{"name": ..., "value": ...}`
+// or an object with the values by name
+func readMetadataJson(metadataFile string) ([]MetadataPair, error) {
+	result := []MetadataPair{}
+	if _, err := os.Stat(metadataFile); os.IsNotExist(err) {
+		return result, nil
 	}
-
-	content, err := ioutil.ReadFile(filename)
+	content, err := ioutil.ReadFile(metadataFile)
 	if err != nil {
-		return []string{}, err
-	}
-	fileLines := strings.Split(string(content), "\n")
-	validLines := make([]string, 0, len(fileLines))
-	for _, l := range fileLines {
-		trimmedLine := strings.Trim(l, "\t ")
-		if trimmedLine != "" {
-			validLines = append(validLines, trimmedLine)
+		return result, err
+	}
+
+	var i interface{}
+	if err := json.Unmarshal(content, &i); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			line := bytes.Count(content[:syntaxErr.Offset], []byte("\n")) + 1
+			return result, fmt.Errorf("metadata.json line %d: invalid JSON: %s", line, err)
 		}
+		return result, fmt.Errorf("metadata.json: invalid JSON: %s", err)
+	}
+
+	switch i := i.(type) {
+	case []interface{}:
+		for n, e := range i {
+			pair, err := newMetadataPairFromInterface(e)
+			if err != nil {
+				return result, fmt.Errorf("metadata.json element %d: %s", n, err)
+			}
+			result = append(result, *pair)
+		}
+	case map[string]interface{}:
+		names := make([]string, 0, len(i))
+		for k := range i {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, k := range names {
+			result = append(result, MetadataPair{Name: k, Value: InterfaceToJsonString(i[k])})
+		}
+	default:
+		return result, fmt.Errorf("metadata.json: expected a list of {name,value} or an object, got %s", InterfaceToJsonString(i))
+	}
+	return result, nil
+}
+
+func newMetadataPairFromInterface(i interface{}) (*MetadataPair, error) {
+	m, ok := i.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected {name,value}, got %s", InterfaceToJsonString(i))
+	}
+	name, ok := m["name"].(string)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("expected {name,value}, missing 'name' in %s", InterfaceToJsonString(i))
+	}
+	value, ok := m["value"]
+	if !ok {
+		return nil, fmt.Errorf("expected {name,value}, missing 'value' in %s", InterfaceToJsonString(i))
 	}
-	return validLines, nil
+	return &MetadataPair{Name: name, Value: InterfaceToJsonString(value)}, nil
 }
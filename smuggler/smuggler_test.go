@@ -1,12 +1,16 @@
 package smuggler_test
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/user"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -343,6 +347,30 @@ var _ = Describe("SmugglerCommand params", func() {
 
 })
 
+var _ = Describe("SmugglerCommand params schema", func() {
+	It("sets the default values of the params", func() {
+		runCommandFromFixture(CheckType, "", "params_schema", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(command.LastCommandOutput).Should(ContainSubstring("region=eu-west-1"))
+	})
+	It("passes the given params", func() {
+		runCommandFromFixture(InType, "/some/path", "params_schema", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(command.LastCommandOutput).Should(ContainSubstring("bucket=my-bucket"))
+		Ω(command.LastCommandOutput).Should(ContainSubstring("region=us-east-1"))
+	})
+	It("fails before running the command, listing all the problems", func() {
+		runCommandFromFixture(OutType, "/some/path", "params_schema", "1.2.3")
+		Ω(err).Should(BeAssignableToTypeOf(&ParamsError{}))
+		Ω(err.(*ParamsError).Problems).Should(Equal([]string{
+			"bucket: required parameter for 'out' is missing",
+			"count: expected integer, got string",
+			`region: invalid value us-west-2, must be one of: ["eu-west-1","us-east-1"]`,
+		}))
+		Ω(command.LastCommand()).Should(BeNil())
+	})
+})
+
 var _ = Describe("SmugglerCommand one line commands", func() {
 	BeforeEach(func() {
 		dataDir = "/some/path"
@@ -381,6 +409,51 @@ var _ = Describe("SmugglerCommand one line commands", func() {
 
 })
 
+var _ = Describe("SmugglerCommand JSON metadata", func() {
+	Context("when the command writes JSON lines in metadata and an object in metadata.json", func() {
+		BeforeEach(func() {
+			runCommandFromFixture(InType, "/some/path", "json_metadata", "1.2.3")
+		})
+		It("returns the metadata of both files", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Metadata).Should(Equal([]MetadataPair{
+				{Name: "plain", Value: "value"},
+				{Name: "changelog", Value: "line 1\nline 2"},
+				{Name: "commit", Value: "abc123"},
+				{Name: "message", Value: "multi\nline"},
+			}))
+		})
+	})
+	Context("when the command writes an invalid JSON line in metadata", func() {
+		BeforeEach(func() {
+			runCommandFromFixture(OutType, "/some/path", "json_metadata", "1.2.3")
+		})
+		It("fails reporting the line number", func() {
+			Ω(err).Should(MatchError(ContainSubstring("metadata line 3: invalid JSON")))
+		})
+	})
+	Context("when the command writes a list in metadata.json", func() {
+		BeforeEach(func() {
+			runCommandFromFixture(InType, "/some/path", "json_metadata_list", "1.2.3")
+		})
+		It("returns the metadata in order", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Metadata).Should(Equal([]MetadataPair{
+				{Name: "first", Value: "1"},
+				{Name: "second", Value: "2"},
+			}))
+		})
+	})
+	Context("when the command writes an invalid metadata.json", func() {
+		BeforeEach(func() {
+			runCommandFromFixture(OutType, "/some/path", "json_metadata_list", "1.2.3")
+		})
+		It("fails reporting the line number", func() {
+			Ω(err).Should(MatchError(ContainSubstring("metadata.json line 3: invalid JSON")))
+		})
+	})
+})
+
 var _ = Describe("SmugglerCommand named versions", func() {
 	JustBeforeEach(func() {
 		runCommandFromFixture(InType, "/some/path", "version_with_names", `{"foo": "foo_version", "bar": "bar_version"}`)
@@ -392,6 +465,545 @@ var _ = Describe("SmugglerCommand named versions", func() {
 	})
 })
 
+var _ = Describe("SmugglerCommand output streaming", func() {
+	var output *bytes.Buffer
+	var outputMode OutputMode
+
+	JustBeforeEach(func() {
+		requestJson, err = pipeline.JsonRequest(CheckType, "complex_command", "a_job", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		request, err = NewResourceRequest(CheckType, requestJson)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		output = new(bytes.Buffer)
+		command = NewSmugglerCommand(logger)
+		command.StreamOutputTo(output, outputMode)
+		response, err = command.RunAction("", request)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	Context("when output mode is 'both'", func() {
+		BeforeEach(func() {
+			outputMode = OutputModeBoth
+		})
+		It("echoes stdout and stderr", func() {
+			Ω(output.String()).Should(ContainSubstring("Command Start\n"))
+			Ω(output.String()).Should(ContainSubstring("Command End\n"))
+		})
+		It("still captures the output", func() {
+			Ω(command.LastCommandOutput).Should(ContainSubstring("Command Start"))
+			Ω(command.LastCommandErr).Should(ContainSubstring("Command End"))
+		})
+	})
+	Context("when output mode is 'both-prefix'", func() {
+		BeforeEach(func() {
+			outputMode = OutputModeBothPrefix
+		})
+		It("echoes each line prefixed by the stream", func() {
+			Ω(output.String()).Should(ContainSubstring("stdout: Command Start\n"))
+			Ω(output.String()).Should(ContainSubstring("stdout: param1=test\n"))
+			Ω(output.String()).Should(ContainSubstring("stderr: Command End\n"))
+		})
+	})
+	Context("when output mode is 'stdout'", func() {
+		BeforeEach(func() {
+			outputMode = OutputModeStdout
+		})
+		It("echoes only stdout", func() {
+			Ω(output.String()).Should(ContainSubstring("Command Start"))
+			Ω(output.String()).ShouldNot(ContainSubstring("Command End"))
+		})
+	})
+	Context("when output mode is 'stderr'", func() {
+		BeforeEach(func() {
+			outputMode = OutputModeStderr
+		})
+		It("echoes only stderr", func() {
+			Ω(output.String()).ShouldNot(ContainSubstring("Command Start"))
+			Ω(output.String()).Should(ContainSubstring("Command End"))
+		})
+	})
+})
+
+var _ = Describe("NewOutputMode", func() {
+	It("defaults to 'both'", func() {
+		m, err := NewOutputMode("")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(m).Should(Equal(OutputModeBoth))
+	})
+	It("fails with an invalid mode", func() {
+		_, err := NewOutputMode("everything")
+		Ω(err).Should(MatchError(ContainSubstring("invalid output_mode 'everything'")))
+	})
+})
+
+var _ = Describe("SmugglerCommand timeouts", func() {
+	var startTime time.Time
+	var elapsed time.Duration
+
+	JustBeforeEach(func() {
+		startTime = time.Now()
+		runCommandFromFixture(requestType, "/some/path", "timeout_command", "1.2.3")
+		elapsed = time.Since(startTime)
+	})
+
+	Context("when the command runs longer than the timeout", func() {
+		BeforeEach(func() {
+			requestType = CheckType
+		})
+		It("returns a timeout error", func() {
+			Ω(err).Should(BeAssignableToTypeOf(&CommandTimeoutError{}))
+			Ω(err).Should(MatchError("command timed out after 1s"))
+		})
+		It("kills the command and its children", func() {
+			Ω(elapsed).Should(BeNumerically("<", 5*time.Second))
+		})
+		It("reports the timeout exit status", func() {
+			Ω(command.LastCommandTimedOut()).Should(BeTrue())
+			Ω(command.LastCommandSuccess()).Should(BeFalse())
+			Ω(command.LastCommandExitStatus()).Should(Equal(TimeoutExitStatus))
+		})
+	})
+
+	Context("when the command ignores SIGTERM", func() {
+		BeforeEach(func() {
+			requestType = InType
+		})
+		It("kills the command after the grace period", func() {
+			Ω(err).Should(BeAssignableToTypeOf(&CommandTimeoutError{}))
+			Ω(elapsed).Should(BeNumerically(">=", 2*time.Second))
+			Ω(elapsed).Should(BeNumerically("<", 5*time.Second))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("ignoring SIGTERM"))
+		})
+	})
+
+	Context("when the command overrides the timeout and finishes in time", func() {
+		BeforeEach(func() {
+			requestType = OutType
+		})
+		It("runs successfully", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(command.LastCommandTimedOut()).Should(BeFalse())
+			Ω(response.Version).Should(Equal(*NewVersion("1.2.3")))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand retries", func() {
+	BeforeEach(func() {
+		dataDir, err = ioutil.TempDir("", "retry_command")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+	JustBeforeEach(func() {
+		runCommandFromFixture(requestType, dataDir, "retry_command", "1.2.3")
+	})
+
+	countAttempts := func() int {
+		b, err := ioutil.ReadFile(filepath.Join(dataDir, "attempts"))
+		Ω(err).ShouldNot(HaveOccurred())
+		return strings.Count(string(b), "\n")
+	}
+
+	Context("when the command fails and then succeeds", func() {
+		BeforeEach(func() {
+			requestType = InType
+		})
+		It("retries until it succeeds", func() {
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(countAttempts()).Should(Equal(3))
+		})
+		It("uses only the output of the last attempt", func() {
+			Ω(response.Version).Should(Equal(*NewVersion("attempt-3")))
+			Ω(command.LastCommandOutput).Should(ContainSubstring("running attempt 3"))
+			Ω(command.LastCommandOutput).ShouldNot(ContainSubstring("running attempt 2"))
+		})
+	})
+
+	Context("when the command fails with an exit code not to retry on", func() {
+		BeforeEach(func() {
+			requestType = OutType
+		})
+		It("does not retry", func() {
+			Ω(err).Should(HaveOccurred())
+			Ω(command.LastCommandExitStatus()).Should(Equal(4))
+			Ω(countAttempts()).Should(Equal(1))
+		})
+	})
+})
+
+var _ = Describe("SmugglerCommand versions format", func() {
+	It("reads multi-key versions from tab separated fields", func() {
+		runCommandFromFixture(CheckType, "", "versions_format_tsv", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{
+			{"ref": "abc", "timestamp": "1"},
+			{"ref": "def", "timestamp": "2"},
+		}))
+	})
+	It("fails with the line number of an invalid line", func() {
+		runCommandFromFixture(InType, "/some/path", "versions_format_tsv", "1.2.3")
+		Ω(err).Should(MatchError("versions line 2: invalid field 'not a field', expected key=value"))
+	})
+	It("reads multi-key versions from URL query like fields", func() {
+		runCommandFromFixture(CheckType, "", "versions_format_query", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{
+			{"ref": "abc", "message": "hello world"},
+		}))
+	})
+})
+
+var _ = Describe("SmugglerCommand default versions", func() {
+	for _, fixture := range []string{"default_versions", "default_versions_with_commands"} {
+		fixture := fixture
+		Context("when running "+fixture, func() {
+			It("check returns the default_check_version", func() {
+				runCommandFromFixture(CheckType, "", fixture, "1.2.3")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Versions).Should(Equal([]Version{{"ID": "static"}}))
+			})
+			It("in returns the default_in_version", func() {
+				runCommandFromFixture(InType, "/some/path", fixture, "1.2.3")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(response.Version).Should(Equal(Version{"ref": "fixed"}))
+			})
+		})
+	}
+	It("the versions reported by the commands take precedence", func() {
+		runCommandFromFixture(CheckType, "", "complex_command", "1.2.3")
+		Ω(response.Versions).Should(Equal(NewVersions([]string{"1.2.3", "1.2.4"})))
+	})
+})
+
+var _ = Describe("SmugglerCommand hooks", func() {
+	var hooksLog string
+
+	BeforeEach(func() {
+		dataDir, err = ioutil.TempDir("", "hooks")
+		Ω(err).ShouldNot(HaveOccurred())
+		hooksLog = filepath.Join(dataDir, "hooks.log")
+		os.Setenv("HOOKS_LOG", hooksLog)
+	})
+	AfterEach(func() {
+		os.Unsetenv("HOOKS_LOG")
+		os.RemoveAll(dataDir)
+	})
+
+	readHooksLog := func() []string {
+		b, err := ioutil.ReadFile(hooksLog)
+		Ω(err).ShouldNot(HaveOccurred())
+		return strings.Split(strings.TrimSpace(string(b)), "\n")
+	}
+
+	It("runs the global and action hooks around the command", func() {
+		runCommandFromFixture(InType, dataDir, "hooks", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(readHooksLog()).Should(Equal([]string{
+			"global pre",
+			"in pre",
+			"in",
+			`in post {"version":{"ID":"1.2.3"}}`,
+			"global post",
+		}))
+	})
+
+	It("reports the state of the command and not of the hooks", func() {
+		runCommandFromFixture(CheckType, dataDir, "hooks", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("1.2.3")}))
+		Ω(command.LastCommand().Args).Should(ContainElement(ContainSubstring(`echo "check"`)))
+	})
+
+	It("runs the on_failure hooks with the exit status when the command fails", func() {
+		runCommandFromFixture(OutType, dataDir, "hooks", "")
+		Ω(err).Should(HaveOccurred())
+		Ω(command.LastCommandExitStatus()).Should(Equal(3))
+		Ω(readHooksLog()).Should(Equal([]string{
+			"global pre",
+			"out",
+			"out on_failure 3 exit status 3",
+			"global on_failure 3",
+		}))
+	})
+
+	It("does not run the command if a pre hook fails", func() {
+		runCommandFromFixture(CheckType, dataDir, "failing_pre_hook", "")
+		Ω(err).Should(MatchError(ContainSubstring("pre hook failed")))
+		Ω(command.LastCommandExitStatus()).Should(Equal(5))
+		Ω(readHooksLog()).Should(Equal([]string{"on_failure 5"}))
+	})
+})
+
+var _ = Describe("SmugglerCommand wrapping a resource", func() {
+	BeforeEach(func() {
+		dataDir, err = ioutil.TempDir("", "wrapped_resource")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dataDir)
+	})
+
+	It("calls the wrapped resource with the filtered request", func() {
+		runCommandFromFixture(CheckType, "", "wrapped_resource", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(command.LastCommandErr).Should(ContainSubstring(`"bucket":"my-bucket"`))
+		Ω(command.LastCommandErr).ShouldNot(ContainSubstring("wrap"))
+	})
+
+	It("transforms the response", func() {
+		runCommandFromFixture(CheckType, "", "wrapped_resource", "")
+		Ω(response.Versions).Should(Equal([]Version{{"ref": "-"}}))
+	})
+
+	It("transforms the request", func() {
+		runCommandFromFixture(InType, dataDir, "wrapped_resource", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		b, err := ioutil.ReadFile(filepath.Join(dataDir, "request.json"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(b).Should(MatchJSON(`{"source": {"bucket": "my-bucket"}, "version": {"ref": "master"}}`))
+		Ω(response.Version).Should(Equal(Version{"ref": "abc"}))
+		Ω(response.Metadata).Should(Equal([]MetadataPair{{Name: "dir", Value: dataDir}}))
+	})
+
+	It("fails if the response is not valid", func() {
+		runCommandFromFixture(OutType, dataDir, "wrapped_resource", "")
+		Ω(err).Should(MatchError(ContainSubstring("wrapped resource: invalid response")))
+	})
+})
+
+var _ = Describe("SmugglerCommand templating", func() {
+	It("renders the commands and the params", func() {
+		runCommandFromFixture(CheckType, "", "templating", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(command.LastCommandOutput).Should(ContainSubstring("url=s3://my-bucket/latest"))
+		Ω(command.LastCommandOutput).Should(ContainSubstring("version=1.2.3"))
+		Ω(command.LastCommandOutput).Should(ContainSubstring(
+			"checksum=a483e74c6d1d86558b8e99bb8b8247e2a169d85f8c8b7c29d789e4b2949e5dec",
+		))
+	})
+
+	It("renders the args of the commands", func() {
+		runCommandFromFixture(InType, "/some/path", "templating", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(command.LastCommandOutput).Should(ContainSubstring("encoded=bXktYnVja2V0"))
+	})
+
+	It("does not modify the request", func() {
+		runCommandFromFixture(CheckType, "", "templating", "1.2.3")
+		Ω(request.Source.SmugglerParams["url"]).Should(ContainSubstring("{{ .source.bucket }}"))
+	})
+
+	It("fails if a required value is missing", func() {
+		runCommandFromFixture(OutType, "/some/path", "templating", "")
+		Ω(err).Should(MatchError(ContainSubstring("params.prefix is required")))
+		Ω(err).Should(MatchError(ContainSubstring("rendering 'commands.out'")))
+	})
+})
+
+var _ = Describe("SmugglerCommand check cache", func() {
+	var cacheLog string
+	var defaultCheckCacheDir string
+
+	BeforeEach(func() {
+		dataDir, err = ioutil.TempDir("", "check-cache")
+		Ω(err).ShouldNot(HaveOccurred())
+		cacheLog = filepath.Join(dataDir, "cache.log")
+		os.Setenv("CACHE_LOG", cacheLog)
+		defaultCheckCacheDir = DefaultCheckCacheDir
+		DefaultCheckCacheDir = filepath.Join(dataDir, "cache")
+	})
+	AfterEach(func() {
+		DefaultCheckCacheDir = defaultCheckCacheDir
+		os.Unsetenv("CACHE_LOG")
+		os.RemoveAll(dataDir)
+	})
+
+	checkRuns := func() int {
+		b, err := ioutil.ReadFile(cacheLog)
+		Ω(err).ShouldNot(HaveOccurred())
+		return strings.Count(string(b), "check\n")
+	}
+
+	runWithSource := func(changeSource func(source map[string]interface{})) {
+		requestJson, err = pipeline.JsonRequest(CheckType, "check_cache", "a_job", "1.0.0")
+		Ω(err).ShouldNot(HaveOccurred())
+		var raw map[string]interface{}
+		Ω(json.Unmarshal([]byte(requestJson), &raw)).Should(Succeed())
+		changeSource(raw["source"].(map[string]interface{}))
+		b, marshalErr := json.Marshal(raw)
+		Ω(marshalErr).ShouldNot(HaveOccurred())
+
+		request, err = NewResourceRequest(CheckType, string(b))
+		Ω(err).ShouldNot(HaveOccurred())
+		command = NewSmugglerCommand(logger)
+		response, err = command.RunAction("", request)
+	}
+
+	It("returns the cached response for the same source and version", func() {
+		runCommandFromFixture(CheckType, "", "check_cache", "1.0.0")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("1.2.1")}))
+
+		runCommandFromFixture(CheckType, "", "check_cache", "1.0.0")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("1.2.1")}))
+		Ω(command.LastCommand()).Should(BeNil())
+		Ω(checkRuns()).Should(Equal(1))
+	})
+
+	It("runs check for another version", func() {
+		runCommandFromFixture(CheckType, "", "check_cache", "1.0.0")
+		runCommandFromFixture(CheckType, "", "check_cache", "2.0.0")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("1.2.2")}))
+		Ω(checkRuns()).Should(Equal(2))
+	})
+
+	It("runs check for a source with other smuggler_params", func() {
+		runWithSource(func(source map[string]interface{}) {
+			source["smuggler_params"] = map[string]interface{}{"region": "eu-west-1"}
+		})
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("1.2.1")}))
+
+		runWithSource(func(source map[string]interface{}) {
+			source["smuggler_params"] = map[string]interface{}{"region": "us-east-1"}
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("1.2.2")}))
+		Ω(checkRuns()).Should(Equal(2))
+	})
+
+	It("runs check again if the command changed", func() {
+		runCommandFromFixture(CheckType, "", "check_cache", "1.0.0")
+		runWithSource(func(source map[string]interface{}) {
+			commands := source["commands"].(map[string]interface{})
+			commands["check"] = "echo check >> ${CACHE_LOG}; echo 2.0.0 > ${SMUGGLER_OUTPUT_DIR}/versions"
+		})
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("2.0.0")}))
+		Ω(checkRuns()).Should(Equal(2))
+	})
+
+	It("runs check when the cached response expired", func() {
+		runCommandFromFixture(CheckType, "", "check_cache", "1.0.0")
+		request.Source.CheckCache.TTL = "1ns"
+		response, err = command.RunAction("", request)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("1.2.2")}))
+		Ω(checkRuns()).Should(Equal(2))
+	})
+
+	It("runs check only once for concurrent checks", func() {
+		runCommandFromFixture(CheckType, "", "check_cache", "1.0.0")
+		os.Remove(cacheLog)
+		request.Version = *NewVersion("3.0.0")
+
+		responses := make(chan *ResourceResponse, 5)
+		for i := 0; i < 5; i++ {
+			go func() {
+				defer GinkgoRecover()
+				r, err := NewSmugglerCommand(logger).RunAction("", request)
+				Ω(err).ShouldNot(HaveOccurred())
+				responses <- r
+			}()
+		}
+		for i := 0; i < 5; i++ {
+			Ω((<-responses).Versions).Should(Equal([]Version{*NewVersion("1.2.1")}))
+		}
+		Ω(checkRuns()).Should(Equal(1))
+	})
+})
+
+var _ = Describe("SmugglerCommand version order", func() {
+	It("sorts, filters and trims the versions reported by check", func() {
+		runCommandFromFixture(CheckType, "", "version_order", "1.9.0")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal(NewVersions([]string{"1.9.0", "1.10.0"})))
+	})
+
+	It("reports only the latest version in the first check", func() {
+		runCommandFromFixture(CheckType, "", "version_order", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(response.Versions).Should(Equal(NewVersions([]string{"1.10.0"})))
+	})
+})
+
+var _ = Describe("SmugglerCommand environment", func() {
+	BeforeEach(func() {
+		os.Setenv("KEEP_ME", "kept")
+		os.Setenv("DROP_ME", "dropped")
+	})
+	AfterEach(func() {
+		os.Unsetenv("KEEP_ME")
+		os.Unsetenv("DROP_ME")
+	})
+
+	It("runs the command in the directory, with the umask and the environment", func() {
+		runCommandFromFixture(CheckType, "", "command_environment", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(strings.Split(string(command.LastCommandOutput), "\n")).Should(Equal([]string{
+			"/",
+			"0027",
+			"FOO=bar",
+			"KEEP=kept",
+			"DROP=",
+			"PARAM=value",
+			"",
+		}))
+	})
+
+	It("does not change the umask of smuggler", func() {
+		runCommandFromFixture(CheckType, "", "command_environment", "")
+		previous := syscall.Umask(0)
+		syscall.Umask(previous)
+		Ω(previous).ShouldNot(Equal(027))
+	})
+
+	It("runs the command as the given user", func() {
+		if os.Getuid() != 0 {
+			Skip("only root can run commands as other users")
+		}
+		nobody, lookupErr := user.Lookup("nobody")
+		Ω(lookupErr).ShouldNot(HaveOccurred())
+		dataDir, err = ioutil.TempDir("", "command-environment")
+		Ω(err).ShouldNot(HaveOccurred())
+		defer os.RemoveAll(dataDir)
+
+		runCommandFromFixture(InType, dataDir, "command_environment", "1.2.3")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(command.LastCommandOutput)).Should(Equal(nobody.Uid + "\nHOME=" + nobody.HomeDir + "\n"))
+		Ω(response.Version).Should(Equal(*NewVersion("1.2.3")))
+	})
+})
+
+var _ = Describe("SmugglerCommand environment names", func() {
+	It("passes the params with the prefix, case and flattened", func() {
+		runCommandFromFixture(CheckType, "", "env_naming", "")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(command.LastCommandOutput)).Should(Equal(
+			`region=eu-west-1 key=AKIA tags=["a","b"] bucket=my-bucket` + "\n",
+		))
+		Ω(response.Versions).Should(Equal([]Version{*NewVersion("1.2.3")}))
+	})
+
+	It("sanitizes the names and fails if two params have the same name", func() {
+		request, err = NewResourceRequest(CheckType, `{
+			"source": {
+				"commands": { "check": "echo" },
+				"a-b": 1,
+				"a.b": 2
+			}
+		}`)
+		Ω(err).ShouldNot(HaveOccurred())
+		command = NewSmugglerCommand(logger)
+		_, err = command.RunAction("", request)
+		Ω(err).Should(MatchError("params 'a-b' and 'a.b' are both exported as 'SMUGGLER_a_b'"))
+	})
+})
+
 func runCommandFromFixture(requestType RequestType, dataDir string, fixtureResourceName string, version string) {
 	requestJson, err = pipeline.JsonRequest(requestType, fixtureResourceName, "a_job", version)
 	Ω(err).ShouldNot(HaveOccurred())
@@ -0,0 +1,195 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/redfactorlabs/concourse-smuggler-resource/helpers/utils"
+)
+
+// Subcommands of smuggler when not called as check/in/out, by name
+var subcommands = map[string]func(args []string) error{
+	"inject": injectSubcommand,
+	"replay": replaySubcommand,
+	"run":    runSubcommand,
+}
+
+// Runs the subcommand given in the arguments, if smuggler is not called
+// as one of the resource commands. Returns false if there is none.
+func RunSubcommand() bool {
+	if _, ok := requestTypeFromCommandName(filepath.Base(os.Args[0])); ok {
+		return false
+	}
+	if len(os.Args) < 2 {
+		return false
+	}
+	subcommand, ok := subcommands[os.Args[1]]
+	if !ok {
+		names := make([]string, 0, len(subcommands))
+		for name := range subcommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		utils.Sayf("usage: %s <%s> [args...]\n", os.Args[0], strings.Join(names, "|"))
+		os.Exit(1)
+	}
+	if err := subcommand(os.Args[2:]); err != nil {
+		utils.Fatal(os.Args[1], err, 1)
+	}
+	return true
+}
+
+func injectSubcommand(args []string) error {
+	flags := flag.NewFlagSet("inject", flag.ExitOnError)
+	name := flags.String("name", DefaultWrappedName, "name of the wrapped resource, in /opt/resource/wrapped/<name>")
+	binary := flags.String("binary", "", "smuggler binary to inject, by default this one")
+	output := flags.String("output", "", "path of the resulting OCI image layout tarball, by default the given one")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s inject [options] <rootfs dir|OCI image layout> <smuggler.yml>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	target, configFile := flags.Arg(0), flags.Arg(1)
+
+	config, err := ReadInjectConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	if *binary == "" {
+		if *binary, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+	content, err := ioutil.ReadFile(*binary)
+	if err != nil {
+		return err
+	}
+
+	err = Inject(target, InjectOptions{
+		Name:   *name,
+		Config: config,
+		Binary: content,
+		Output: *output,
+	})
+	if err != nil {
+		return fmt.Errorf("injecting smuggler in '%s': %s", target, err)
+	}
+	utils.Sayf("Injected smuggler in '%s'\n", target)
+	return nil
+}
+
+func runSubcommand(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	pipelineFile := flags.String("pipeline", "", "pipeline file with the resource")
+	resourceName := flags.String("resource", "", "name of the resource in the pipeline")
+	jobName := flags.String("job", "", "name of the job with the get/put step of the resource, for its params")
+	action := flags.String("action", string(CheckType), "action to run: check, in or out")
+	version := flags.String("version", "", "version for check and in, as JSON or as the ID")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s run -pipeline <pipeline.yml> -resource <name> [options] [destination or sources dir]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *pipelineFile == "" || *resourceName == "" || flags.NArg() > 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+	requestType := RequestType(*action)
+	if !contains(commandNames, *action) {
+		return fmt.Errorf("invalid action '%s', must be one of: %s", *action, strings.Join(commandNames, ", "))
+	}
+
+	dataDir := flags.Arg(0)
+	switch requestType {
+	case InType:
+		if dataDir == "" {
+			return fmt.Errorf("missing destination directory for 'in'")
+		}
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return err
+		}
+	case OutType:
+		if dataDir == "" {
+			return fmt.Errorf("missing sources directory for 'out'")
+		}
+	}
+
+	content, err := ioutil.ReadFile(*pipelineFile)
+	if err != nil {
+		return err
+	}
+	pipeline, err := ParsePipeline(content)
+	if err != nil {
+		return fmt.Errorf("parsing '%s': %s", *pipelineFile, err)
+	}
+	var v Version
+	if *version != "" {
+		v = *NewVersion(*version)
+	}
+	rawRequest, err := pipeline.RawRequest(requestType, *resourceName, *jobName, v)
+	if err != nil {
+		return err
+	}
+	input, err := json.Marshal(rawRequest)
+	if err != nil {
+		return err
+	}
+
+	tempFileLogger := OpenSmugglerLog()
+	request := ParseInputAndConfig(requestType, input, FindAndReadSmugglerConfig(tempFileLogger.Logger))
+	RunRequest(dataDir, request, input, tempFileLogger)
+	return nil
+}
+
+func replaySubcommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	command := flags.String("command", "", "command to run instead of the one of the action")
+	dir := flags.String("dir", "", "destination or sources directory, by default the one of the bundle")
+	flags.Usage = func() {
+		utils.Sayf("usage: %s replay [options] <bundle.json>\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(1)
+	}
+
+	bundle, err := ReadReplayBundle(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	input, err := bundle.RequestJson(*command)
+	if err != nil {
+		return err
+	}
+	dataDir := bundle.DataDir
+	if *dir != "" {
+		dataDir = *dir
+	}
+	if bundle.Action == InType {
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := bundle.RestoreEnv(); err != nil {
+		return err
+	}
+
+	tempFileLogger := OpenSmugglerLog()
+	// The request is already merged with smuggler.yml
+	request := ParseInputAndConfig(bundle.Action, input, nil)
+	RunRequest(dataDir, request, input, tempFileLogger)
+	return nil
+}
@@ -0,0 +1,232 @@
+package smuggler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// Functions available in the templates, besides the text/template builtins
+var templateFuncs = template.FuncMap{
+	// Renders the value as JSON
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// Returns the given value, or the default one if it is empty
+	"default": func(defaultValue interface{}, v interface{}) interface{} {
+		if isEmptyValue(v) {
+			return defaultValue
+		}
+		return v
+	},
+	// Fails with the given message if the value is empty
+	"required": func(message string, v interface{}) (interface{}, error) {
+		if isEmptyValue(v) {
+			return nil, errors.New(message)
+		}
+		return v, nil
+	},
+	"b64enc": func(v interface{}) string {
+		return base64.StdEncoding.EncodeToString([]byte(InterfaceToJsonString(v)))
+	},
+	// Hex encoded SHA256 checksum
+	"sha256": func(v interface{}) string {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(InterfaceToJsonString(v))))
+	},
+}
+
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+func renderTemplate(name string, text string, data interface{}) ([]byte, error) {
+	t, err := parseTemplate(name, text)
+	if err != nil {
+		return nil, err
+	}
+	buffer := new(bytes.Buffer)
+	if err := t.Execute(buffer, data); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.String, reflect.Map, reflect.Slice, reflect.Array:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	}
+	return false
+}
+
+// Data available in the templates of the commands and params, with
+// `templating: true`
+func (request *ResourceRequest) templateData() map[string]interface{} {
+	env := map[string]interface{}{}
+	for _, e := range os.Environ() {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			env[kv[0]] = kv[1]
+		}
+	}
+	version := map[string]interface{}{}
+	for k, v := range request.Version {
+		version[k] = v
+	}
+	return map[string]interface{}{
+		"action":  string(request.Type),
+		"source":  copyMaps(request.Source.SmugglerParams, request.Source.ExtraParams),
+		"params":  copyMaps(request.Params.SmugglerParams, request.Params.ExtraParams),
+		"version": version,
+		"env":     env,
+	}
+}
+
+// Returns a copy of the request with the command and hooks of the action
+// and the params rendered as templates against the request.
+func (request *ResourceRequest) RenderTemplates() (*ResourceRequest, error) {
+	data := request.templateData()
+	rendered := *request
+
+	var err error
+	if rendered.Source.Commands, err = renderCommands("commands", request.Type, request.Source.Commands, data); err != nil {
+		return nil, err
+	}
+	if rendered.Source.Hooks, err = renderHooks("hooks", request.Type, request.Source.Hooks, data); err != nil {
+		return nil, err
+	}
+	params := []struct {
+		path   string
+		params *map[string]interface{}
+	}{
+		{"source.smuggler_params", &rendered.Source.SmugglerParams},
+		{"source", &rendered.Source.ExtraParams},
+		{"params.smuggler_params", &rendered.Params.SmugglerParams},
+		{"params", &rendered.Params.ExtraParams},
+	}
+	for _, p := range params {
+		if *p.params == nil {
+			continue
+		}
+		v, err := renderValue(p.path, *p.params, data)
+		if err != nil {
+			return nil, err
+		}
+		*p.params = v.(map[string]interface{})
+	}
+	return &rendered, nil
+}
+
+// Renders only the command of the action, as the others might use
+// values which are not given for it
+func renderCommands(path string, action RequestType, commands map[string]interface{}, data interface{}) (map[string]interface{}, error) {
+	cmd, ok := commands[string(action)]
+	if !ok {
+		return commands, nil
+	}
+	rendered := copyMaps(commands)
+	c, err := renderCommand(joinPath(path, string(action)), cmd, data)
+	if err != nil {
+		return nil, err
+	}
+	rendered[string(action)] = c
+	return rendered, nil
+}
+
+// Renders the global hooks and the ones of the action
+func renderHooks(path string, action RequestType, hooks map[string]interface{}, data interface{}) (map[string]interface{}, error) {
+	if hooks == nil {
+		return nil, nil
+	}
+	rendered := copyMaps(hooks)
+	for name, h := range hooks {
+		var err error
+		switch {
+		case contains(hookTypes, name):
+			rendered[name], err = renderCommand(joinPath(path, name), h, data)
+		case name == string(action):
+			if actionHooks, ok := h.(map[string]interface{}); ok {
+				rendered[name], err = renderHooks(joinPath(path, name), action, actionHooks, data)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rendered, nil
+}
+
+// Renders a command as a string, or the path, args, dir and env of a
+// {path,args}
+func renderCommand(path string, cmd interface{}, data interface{}) (interface{}, error) {
+	switch cmd := cmd.(type) {
+	case string:
+		return renderValue(path, cmd, data)
+	case map[string]interface{}:
+		rendered := copyMaps(cmd)
+		for _, k := range []string{"path", "args", "dir", "env"} {
+			if v, ok := cmd[k]; ok {
+				r, err := renderValue(joinPath(path, k), v, data)
+				if err != nil {
+					return nil, err
+				}
+				rendered[k] = r
+			}
+		}
+		return rendered, nil
+	default:
+		return cmd, nil
+	}
+}
+
+// Renders all the strings in the value, recursively in lists and maps
+func renderValue(path string, v interface{}, data interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		b, err := renderTemplate(path, v, data)
+		if err != nil {
+			return nil, fmt.Errorf("rendering '%s': %s", path, err)
+		}
+		return string(b), nil
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, e := range v {
+			r, err := renderValue(fmt.Sprintf("%s[%d]", path, i), e, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = r
+		}
+		return rendered, nil
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			r, err := renderValue(joinPath(path, k), e, data)
+			if err != nil {
+				return nil, err
+			}
+			rendered[k] = r
+		}
+		return rendered, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,702 @@
+package smuggler
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// Error with the list of problems found validating the configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid configuration:\n  - %s", strings.Join(e.Problems, "\n  - "))
+}
+
+func newValidationError(problems []string) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: problems}
+}
+
+// Validates the value in the given path, returning the problems found
+type validator func(path string, v interface{}) []string
+
+// Known keys of the smuggler configuration in `source` or `smuggler.yml`
+var sourceSchema = map[string]validator{
+	"check_cache":           validateCheckCache,
+	"commands":              validateCommands,
+	"default_check_version": validateVersion,
+	"default_in_version":    validateVersion,
+	"env_case":              validateWith(func(s string) error { _, err := NewEnvCase(s); return err }),
+	"env_flatten":           validateBool,
+	"env_prefix":            validateString,
+	"filter_raw_request":    validateBool,
+	"grace_period":          validateDuration,
+	"hooks":                 validateHooks,
+	"output_mode":           validateWith(func(s string) error { _, err := NewOutputMode(s); return err }),
+	"params_schema":         validateParamsSchema,
+	"profile":               validateString,
+	"replay_dir":            validateString,
+	"smuggler_debug":        validateBool,
+	"secret_params":         validateListOf(validateString),
+	"smuggler_params":       validateMap,
+	"templating":            validateBool,
+	"timeout":               validateDuration,
+	"version_filter":        validateVersionFilter,
+	"version_order":         validateWith(func(s string) error { _, err := NewVersionOrder(s); return err }),
+	"version_store":         validateVersionStore,
+	"versions_format":       validateWith(func(s string) error { _, err := NewVersionsFormat(s); return err }),
+	"wrap":                  validateWrap,
+}
+
+// Known keys of the smuggler configuration in `params`
+var paramsSchema = map[string]validator{
+	"smuggler_params": validateMap,
+}
+
+// Known keys of the environment of the commands
+var commandEnvironmentSchema = map[string]validator{
+	"dir":             validateString,
+	"user":            validateString,
+	"uid":             validateInt,
+	"gid":             validateInt,
+	"umask":           validateWith(func(s string) error { _, err := parseUmask(s); return err }),
+	"env":             validateEnv,
+	"env_passthrough": validateListOf(validateString),
+	"clear_env":       validateBool,
+}
+
+// Known keys of a command definition as a hash
+var commandDefinitionSchema = withSchema(commandEnvironmentSchema, map[string]validator{
+	"path":                validateString,
+	"args":                validateListOf(validateString),
+	"engine":              validateEnum(scriptEngines),
+	"script":              validateString,
+	"timeout":             validateDuration,
+	"grace_period":        validateDuration,
+	"retries":             validateInt,
+	"backoff":             validateDuration,
+	"max_delay":           validateDuration,
+	"retry_on_exit_codes": validateListOf(validateInt),
+})
+
+// Known keys of the check cache definition
+var checkCacheSchema = map[string]validator{
+	"ttl": validateDuration,
+	"dir": validateString,
+}
+
+// Known keys of the version store, by type
+var versionStoreSchema = map[string]validator{
+	"type":         validateEnum(versionStoreTypes),
+	"key":          validateString,
+	"max_versions": validateInt,
+}
+
+var versionStoreTypeSchemas = map[VersionStoreType]map[string]validator{
+	VersionStoreDir: withSchema(versionStoreSchema, map[string]validator{
+		"dir": validateString,
+	}),
+	VersionStoreS3: withSchema(versionStoreSchema, map[string]validator{
+		"bucket":            validateString,
+		"endpoint":          validateString,
+		"region":            validateString,
+		"access_key_id":     validateString,
+		"secret_access_key": validateString,
+		"session_token":     validateString,
+	}),
+}
+
+// Keys required by each type of version store
+var versionStoreRequiredKeys = map[VersionStoreType]string{
+	VersionStoreDir: "dir",
+	VersionStoreS3:  "bucket",
+}
+
+// Known keys of the version filter
+var versionFilterSchema = map[string]validator{
+	"regex":  validateWith(func(s string) error { _, err := regexp.Compile(s); return err }),
+	"semver": validateWith(func(s string) error { _, err := semver.NewConstraint(s); return err }),
+	"key":    validateString,
+}
+
+// Known keys of the wrapped resource definition
+var wrapSchema = withSchema(commandEnvironmentSchema, map[string]validator{
+	"path":               validateString,
+	"request_transform":  validateActionTemplates,
+	"response_transform": validateActionTemplates,
+})
+
+// Known keys of a parameter declaration in `params_schema`
+var paramDefinitionSchema = map[string]validator{
+	"type":      validateEnum(paramTypes),
+	"default":   validateAny,
+	"required":  validateBool,
+	"enum":      validateListOf(validateAny),
+	"actions":   validateListOf(validateEnum(commandNames)),
+	"sensitive": validateBool,
+}
+
+// Returns a schema with the keys of all the given ones
+func withSchema(schemas ...map[string]validator) map[string]validator {
+	result := map[string]validator{}
+	for _, schema := range schemas {
+		for k, v := range schema {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+var commandNames = []string{string(CheckType), string(InType), string(OutType)}
+
+// Validates the smuggler configuration of a request, with the source,
+// version and params as decoded from JSON
+func ValidateRequest(source, version, params map[string]interface{}) error {
+	problems := validateSourceKeys("source", source, sourceSchema)
+	for _, k := range sortedKeys(version) {
+		if _, ok := version[k].(string); !ok {
+			problems = append(problems, fmt.Sprintf("version.%s: expected string, got %s", k, typeName(version[k])))
+		}
+	}
+	for _, k := range sortedKeys(params) {
+		if validate, ok := paramsSchema[k]; ok {
+			problems = append(problems, validate("params."+k, params[k])...)
+		}
+	}
+	return newValidationError(problems)
+}
+
+// Known keys of smuggler.yml, which also has the files to include, the
+// merge strategies and the profiles
+var configSchema = withSchema(sourceSchema, map[string]validator{
+	IncludeKey:         validateInclude,
+	MergeStrategiesKey: validateMergeStrategies,
+	ProfilesKey:        validateProfiles,
+})
+
+// Validates the content of smuggler.yml
+func ValidateConfig(config map[string]interface{}) error {
+	problems := validateSourceKeys("", config, configSchema)
+	for i, p := range problems {
+		problems[i] = "smuggler.yml: " + p
+	}
+	return newValidationError(problems)
+}
+
+// Validates the known keys of a source. Any other key is a parameter for
+// the commands, unless it is a typo of a smuggler key.
+func validateSourceKeys(path string, source map[string]interface{}, schema map[string]validator) []string {
+	problems := []string{}
+	for _, k := range sortedKeys(source) {
+		if validate, ok := schema[k]; ok {
+			problems = append(problems, validate(joinPath(path, k), source[k])...)
+		} else if suggestion, typo := similarSourceKey(k, source, schema); typo {
+			problems = append(problems, fmt.Sprintf(
+				"%s: unknown smuggler key, did you mean '%s'? Use 'smuggler_params' for parameters with similar names",
+				joinPath(path, k), suggestion,
+			))
+		}
+	}
+	return problems
+}
+
+// Returns a warning for each key of the source passed as a parameter to
+// the commands, but similar to a smuggler key
+func sourceKeyWarnings(path string, source map[string]interface{}, schema map[string]validator) []string {
+	warnings := []string{}
+	for _, k := range sortedKeys(source) {
+		if _, ok := schema[k]; ok {
+			continue
+		}
+		if suggestion, typo := similarSourceKey(k, source, schema); suggestion != "" && !typo {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s: passed as a parameter, but it is similar to the smuggler key '%s'",
+				joinPath(path, k), suggestion,
+			))
+		}
+	}
+	return warnings
+}
+
+// Returns the smuggler key similar to an unknown key of the source, and
+// whether it is a typo of it: the smuggler key is missing and the value is
+// valid for it. Otherwise the key is a parameter with a similar name.
+func similarSourceKey(key string, source map[string]interface{}, schema map[string]validator) (string, bool) {
+	suggestion := suggestKey(key, schemaKeys(schema))
+	if suggestion == "" {
+		return "", false
+	}
+	if _, ok := source[suggestion]; ok {
+		return suggestion, false
+	}
+	return suggestion, len(schema[suggestion](suggestion, source[key])) == 0
+}
+
+func validateParamsSchema(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected map of parameters, got %s", path, typeName(v))}
+	}
+	problems := []string{}
+	for _, name := range sortedKeys(m) {
+		p := joinPath(path, name)
+		definition, ok := m[name].(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected map, got %s", p, typeName(m[name])))
+			continue
+		}
+		problems = append(problems, validateKeys(p, definition, paramDefinitionSchema)...)
+	}
+	return problems
+}
+
+func validateCommands(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected map of commands, got %s", path, typeName(v))}
+	}
+	problems := []string{}
+	for _, k := range sortedKeys(m) {
+		p := joinPath(path, k)
+		if !contains(commandNames, k) {
+			problems = append(problems, unknownKeyProblem(p, k, commandNames))
+			continue
+		}
+		problems = append(problems, validateCommandDefinition(p, m[k])...)
+	}
+	return problems
+}
+
+func validateCommandDefinition(path string, v interface{}) []string {
+	switch c := v.(type) {
+	case string:
+		return nil
+	case map[string]interface{}:
+		if _, ok := c["engine"]; ok {
+			return validateScriptDefinition(path, c)
+		}
+		problems := []string{}
+		if _, ok := c["path"]; !ok {
+			problems = append(problems, fmt.Sprintf("%s: missing required key 'path'", path))
+		}
+		return append(problems, validateKeys(path, c, commandDefinitionSchema)...)
+	default:
+		return []string{fmt.Sprintf("%s: expected string or {path,args}, got %s", path, typeName(v))}
+	}
+}
+
+// Commands with an inline script run by smuggler, which is parsed to
+// report the syntax errors
+func validateScriptDefinition(path string, c map[string]interface{}) []string {
+	problems := []string{}
+	for _, k := range scriptUnsupportedKeys {
+		if _, ok := c[k]; ok {
+			problems = append(problems, fmt.Sprintf("%s.%s: not supported with 'engine'", path, k))
+		}
+	}
+	script, ok := c["script"]
+	if !ok {
+		problems = append(problems, fmt.Sprintf("%s: missing required key 'script'", path))
+	}
+	problems = append(problems, validateKeys(path, c, commandDefinitionSchema)...)
+	if s, ok := script.(string); ok && c["engine"] == string(ScriptEngineStarlark) {
+		if _, err := scriptFileOptions.Parse("script", s, 0); err != nil {
+			problems = append(problems, fmt.Sprintf("%s.script: %s", path, err))
+		}
+	}
+	return problems
+}
+
+// Hooks for all the actions, and for each action by name
+func validateHooks(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected map of hooks, got %s", path, typeName(v))}
+	}
+	validKeys := append(append([]string{}, hookTypes...), commandNames...)
+	problems := []string{}
+	for _, k := range sortedKeys(m) {
+		p := joinPath(path, k)
+		switch {
+		case contains(hookTypes, k):
+			problems = append(problems, validateCommandDefinition(p, m[k])...)
+		case contains(commandNames, k):
+			actionHooks, ok := m[k].(map[string]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s: expected map of hooks, got %s", p, typeName(m[k])))
+				continue
+			}
+			for _, h := range sortedKeys(actionHooks) {
+				if !contains(hookTypes, h) {
+					problems = append(problems, unknownKeyProblem(joinPath(p, h), h, hookTypes))
+					continue
+				}
+				problems = append(problems, validateCommandDefinition(joinPath(p, h), actionHooks[h])...)
+			}
+		default:
+			problems = append(problems, unknownKeyProblem(p, k, validKeys))
+		}
+	}
+	return problems
+}
+
+func validateWrap(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected {path,request_transform,response_transform}, got %s", path, typeName(v))}
+	}
+	problems := []string{}
+	if _, ok := m["path"]; !ok {
+		problems = append(problems, fmt.Sprintf("%s: missing required key 'path'", path))
+	}
+	return append(problems, validateKeys(path, m, wrapSchema)...)
+}
+
+func validateCheckCache(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected {ttl,dir}, got %s", path, typeName(v))}
+	}
+	problems := []string{}
+	if _, ok := m["ttl"]; !ok {
+		problems = append(problems, fmt.Sprintf("%s: missing required key 'ttl'", path))
+	}
+	return append(problems, validateKeys(path, m, checkCacheSchema)...)
+}
+
+func validateVersionStore(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected {type,...}, got %s", path, typeName(v))}
+	}
+	t, ok := m["type"]
+	if !ok {
+		return []string{fmt.Sprintf("%s: missing required key 'type'", path)}
+	}
+	schema, ok := versionStoreTypeSchemas[VersionStoreType(fmt.Sprint(t))]
+	if !ok {
+		return validateEnum(versionStoreTypes)(joinPath(path, "type"), t)
+	}
+	problems := []string{}
+	required := versionStoreRequiredKeys[VersionStoreType(fmt.Sprint(t))]
+	if _, ok := m[required]; !ok {
+		problems = append(problems, fmt.Sprintf("%s: missing required key '%s'", path, required))
+	}
+	if n, ok := m["max_versions"].(float64); ok && n < 0 {
+		problems = append(problems, fmt.Sprintf("%s: must not be negative, got %v", joinPath(path, "max_versions"), n))
+	}
+	return append(problems, validateKeys(path, m, schema)...)
+}
+
+func validateVersionFilter(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected {regex,semver,key}, got %s", path, typeName(v))}
+	}
+	return validateKeys(path, m, versionFilterSchema)
+}
+
+// A file or a list of files to include, which can be glob patterns
+func validateInclude(path string, v interface{}) []string {
+	if _, ok := v.(string); ok {
+		return nil
+	}
+	return validateListOf(validateString)(path, v)
+}
+
+// Profiles by name, each one with the configuration of a source
+func validateProfiles(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected map of profiles, got %s", path, typeName(v))}
+	}
+	problems := []string{}
+	for _, name := range sortedKeys(m) {
+		p := joinPath(path, name)
+		profile, ok := m[name].(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: expected map, got %s", p, typeName(m[name])))
+			continue
+		}
+		problems = append(problems, validateSourceKeys(p, profile, sourceSchema)...)
+	}
+	return problems
+}
+
+// Merge strategies by the path of the value, like `smuggler_params.tags`
+func validateMergeStrategies(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected map of strategies by path, got %s", path, typeName(v))}
+	}
+	problems := []string{}
+	for _, k := range sortedKeys(m) {
+		problems = append(problems, validateEnum(mergeStrategies)(joinPath(path, k), m[k])...)
+	}
+	return problems
+}
+
+// A template for all the actions, or a map of templates by action
+func validateActionTemplates(path string, v interface{}) []string {
+	if _, ok := v.(map[string]interface{}); !ok {
+		return validateTemplate(path, v)
+	}
+	schema := map[string]validator{}
+	for _, name := range commandNames {
+		schema[name] = validateTemplate
+	}
+	return validateKeys(path, v.(map[string]interface{}), schema)
+}
+
+func validateTemplate(path string, v interface{}) []string {
+	s, ok := v.(string)
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected template, got %s", path, typeName(v))}
+	}
+	if _, err := parseTemplate(path, s); err != nil {
+		return []string{fmt.Sprintf("%s: invalid template: %s", path, err)}
+	}
+	return nil
+}
+
+// Variables of the environment, as a map of strings
+func validateEnv(path string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected map of strings, got %s", path, typeName(v))}
+	}
+	problems := []string{}
+	for _, k := range sortedKeys(m) {
+		if k == "" || strings.ContainsAny(k, "= ") {
+			problems = append(problems, fmt.Sprintf("%s: invalid variable name '%s'", path, k))
+			continue
+		}
+		problems = append(problems, validateString(joinPath(path, k), m[k])...)
+	}
+	return problems
+}
+
+// A version as a string, or a map of strings
+func validateVersion(path string, v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return nil
+	case map[string]interface{}:
+		problems := []string{}
+		for _, k := range sortedKeys(v) {
+			problems = append(problems, validateString(joinPath(path, k), v[k])...)
+		}
+		return problems
+	default:
+		return []string{fmt.Sprintf("%s: expected string or map of strings, got %s", path, typeName(v))}
+	}
+}
+
+// Validates the keys of a map with the given schema, reporting unknown keys
+func validateKeys(path string, m map[string]interface{}, schema map[string]validator) []string {
+	problems := []string{}
+	for _, k := range sortedKeys(m) {
+		p := joinPath(path, k)
+		if validate, ok := schema[k]; ok {
+			problems = append(problems, validate(p, m[k])...)
+		} else {
+			problems = append(problems, unknownKeyProblem(p, k, schemaKeys(schema)))
+		}
+	}
+	return problems
+}
+
+func validateBool(path string, v interface{}) []string {
+	if _, ok := v.(bool); !ok {
+		return []string{fmt.Sprintf("%s: expected boolean, got %s", path, typeName(v))}
+	}
+	return nil
+}
+
+func validateString(path string, v interface{}) []string {
+	if _, ok := v.(string); !ok {
+		return []string{fmt.Sprintf("%s: expected string, got %s", path, typeName(v))}
+	}
+	return nil
+}
+
+func validateMap(path string, v interface{}) []string {
+	if _, ok := v.(map[string]interface{}); !ok {
+		return []string{fmt.Sprintf("%s: expected map, got %s", path, typeName(v))}
+	}
+	return nil
+}
+
+func validateInt(path string, v interface{}) []string {
+	if f, ok := v.(float64); !ok || f != float64(int(f)) {
+		return []string{fmt.Sprintf("%s: expected integer, got %s", path, typeName(v))}
+	}
+	return nil
+}
+
+func validateAny(path string, v interface{}) []string {
+	return nil
+}
+
+// Validates a list with the given validator for each element
+func validateListOf(validateElement validator) validator {
+	return func(path string, v interface{}) []string {
+		l, ok := v.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: expected list, got %s", path, typeName(v))}
+		}
+		problems := []string{}
+		for i, e := range l {
+			problems = append(problems, validateElement(fmt.Sprintf("%s[%d]", path, i), e)...)
+		}
+		return problems
+	}
+}
+
+// Validates a string which must be one of the given values
+func validateEnum(values []string) validator {
+	return func(path string, v interface{}) []string {
+		if problems := validateString(path, v); problems != nil {
+			return problems
+		}
+		if !contains(values, v.(string)) {
+			return []string{fmt.Sprintf("%s: invalid value '%s', must be one of: %s", path, v, strings.Join(values, ", "))}
+		}
+		return nil
+	}
+}
+
+func validateDuration(path string, v interface{}) []string {
+	s, ok := v.(string)
+	if !ok {
+		return []string{fmt.Sprintf("%s: expected duration like '30s' or '5m', got %s", path, typeName(v))}
+	}
+	if _, err := time.ParseDuration(s); err != nil {
+		return []string{fmt.Sprintf("%s: expected duration like '30s' or '5m', got '%s'", path, s)}
+	}
+	return nil
+}
+
+// Validates a string with the given parse function
+func validateWith(parse func(string) error) validator {
+	return func(path string, v interface{}) []string {
+		if problems := validateString(path, v); problems != nil {
+			return problems
+		}
+		if err := parse(v.(string)); err != nil {
+			return []string{fmt.Sprintf("%s: %s", path, err)}
+		}
+		return nil
+	}
+}
+
+func unknownKeyProblem(path string, key string, validKeys []string) string {
+	if suggestion := suggestKey(key, validKeys); suggestion != "" {
+		return fmt.Sprintf("%s: unknown key, did you mean '%s'?", path, suggestion)
+	}
+	return fmt.Sprintf("%s: unknown key, expected one of: %s", path, strings.Join(validKeys, ", "))
+}
+
+// Returns the valid key most similar to the given key, if it is close
+// enough to be a typo
+func suggestKey(key string, validKeys []string) string {
+	best, bestDistance := "", 3
+	for _, k := range validKeys {
+		if d := levenshtein(key, k); d < bestDistance {
+			best, bestDistance = k, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func schemaKeys(schema map[string]validator) []string {
+	keys := make([]string, 0, len(schema))
+	for k := range schema {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
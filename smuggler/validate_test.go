@@ -0,0 +1,357 @@
+package smuggler_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+func validateRequestJson(s string) error {
+	var r struct {
+		Source  map[string]interface{} `json:"source"`
+		Version map[string]interface{} `json:"version"`
+		Params  map[string]interface{} `json:"params"`
+	}
+	err := json.Unmarshal([]byte(s), &r)
+	Ω(err).ShouldNot(HaveOccurred())
+	return ValidateRequest(r.Source, r.Version, r.Params)
+}
+
+func validationProblems(err error) []string {
+	Ω(err).Should(BeAssignableToTypeOf(&ValidationError{}))
+	return err.(*ValidationError).Problems
+}
+
+var _ = Describe("ValidateRequest", func() {
+	It("accepts a valid request", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"commands": {
+					"check": "echo check",
+					"in": { "path": "bash", "args": ["-c", "echo in"], "timeout": "1m", "retries": 2 }
+				},
+				"smuggler_debug": true,
+				"output_mode": "both-prefix",
+				"some_param": [ "any", "value" ]
+			},
+			"version": { "ID": "1.2.3" },
+			"params": { "smuggler_params": { "a": 1 }, "other": 2 }
+		}`)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	It("reports the path and the expected type of the commands", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"commands": {
+					"in": [ "bash", "-c", "echo" ],
+					"out": { "args": "echo", "timeout": 10 }
+				}
+			}
+		}`)
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"source.commands.in: expected string or {path,args}, got list",
+			"source.commands.out: missing required key 'path'",
+			"source.commands.out.args: expected list, got string",
+			"source.commands.out.timeout: expected duration like '30s' or '5m', got number",
+		}))
+	})
+	It("reports unknown keys and typos", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"comands": { "check": "echo" },
+				"hooks": {
+					"chek": { "pre": "echo" },
+					"in": { "pre": { "pat": "echo", "path": "echo" } }
+				},
+				"smuggler_debug": "yes"
+			}
+		}`)
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"source.comands: unknown smuggler key, did you mean 'commands'? Use 'smuggler_params' for parameters with similar names",
+			"source.hooks.chek: unknown key, did you mean 'check'?",
+			"source.hooks.in.pre.pat: unknown key, did you mean 'path'?",
+			"source.smuggler_debug: expected boolean, got string",
+		}))
+	})
+	It("passes the keys similar to the smuggler ones as params if they are not typos", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"command": "echo",
+				"comands": { "check": "echo" },
+				"commands": { "check": "echo" },
+				"smuggler_debg": "yes"
+			}
+		}`)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	It("reports invalid versions and params", func() {
+		err := validateRequestJson(`{
+			"source": { "output_mode": "all" },
+			"version": { "ID": 123 },
+			"params": { "smuggler_params": "none" }
+		}`)
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"source.output_mode: invalid output_mode 'all', must be one of: both-prefix, both, stdout, stderr",
+			"version.ID: expected string, got number",
+			"params.smuggler_params: expected map, got string",
+		}))
+	})
+})
+
+var _ = Describe("ValidateConfig", func() {
+	It("reports the problems in params_schema", func() {
+		err := ValidateConfig(map[string]interface{}{
+			"params_schema": map[string]interface{}{
+				"bucket": map[string]interface{}{
+					"type":     "text",
+					"requird":  true,
+					"actions":  []interface{}{"get"},
+					"default":  "any",
+					"required": true,
+				},
+				"region": "eu-west-1",
+			},
+		})
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"smuggler.yml: params_schema.bucket.actions[0]: invalid value 'get', must be one of: check, in, out",
+			"smuggler.yml: params_schema.bucket.requird: unknown key, did you mean 'required'?",
+			"smuggler.yml: params_schema.bucket.type: invalid value 'text', must be one of: any, string, number, integer, boolean, list, map",
+			"smuggler.yml: params_schema.region: expected map, got string",
+		}))
+	})
+	It("reports invalid merge strategies in smuggler.yml", func() {
+		err := ValidateConfig(map[string]interface{}{
+			"merge_strategies": map[string]interface{}{"smuggler_params.tags": "prepend"},
+		})
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"smuggler.yml: merge_strategies.smuggler_params.tags: invalid value 'prepend', must be one of: merge, replace, append",
+		}))
+	})
+	It("reports invalid profiles in smuggler.yml", func() {
+		err := ValidateConfig(map[string]interface{}{
+			"profiles": map[string]interface{}{
+				"s3":  map[string]interface{}{"timeout": "never"},
+				"git": "echo",
+			},
+		})
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"smuggler.yml: profiles.git: expected map, got string",
+			"smuggler.yml: profiles.s3.timeout: expected duration like '30s' or '5m', got 'never'",
+		}))
+	})
+	It("reports the problems in smuggler.yml", func() {
+		err := ValidateConfig(map[string]interface{}{
+			"commands": "echo",
+		})
+		Ω(err).Should(MatchError(ContainSubstring("smuggler.yml: commands: expected map of commands, got string")))
+	})
+})
+
+var _ = Describe("ValidateRequest version store", func() {
+	It("accepts the version stores", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"version_store": { "type": "s3", "bucket": "versions", "endpoint": "https://minio", "max_versions": 10 }
+			}
+		}`)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	It("reports invalid version stores", func() {
+		Ω(validationProblems(validateRequestJson(`{
+			"source": { "version_store": { "type": "git" } }
+		}`))).Should(Equal([]string{
+			"source.version_store.type: invalid value 'git', must be one of: dir, s3",
+		}))
+		Ω(validationProblems(validateRequestJson(`{
+			"source": { "version_store": { "type": "dir", "bucket": "versions", "max_versions": -1 } }
+		}`))).Should(Equal([]string{
+			"source.version_store: missing required key 'dir'",
+			"source.version_store.max_versions: must not be negative, got -1",
+			"source.version_store.bucket: unknown key, expected one of: dir, key, max_versions, type",
+		}))
+	})
+})
+
+var _ = Describe("ValidateRequest scripts", func() {
+	It("accepts commands with a script", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"commands": {
+					"check": { "engine": "starlark", "script": "add_version('1')", "timeout": "1m", "env": { "A": "b" } }
+				}
+			}
+		}`)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	It("reports invalid scripts", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"commands": {
+					"check": { "engine": "lua", "script": "print(1)" },
+					"in": { "engine": "starlark", "path": "sh", "user": "nobody" },
+					"out": { "engine": "starlark", "script": "def f(:" }
+				}
+			}
+		}`)
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"source.commands.check.engine: invalid value 'lua', must be one of: starlark",
+			"source.commands.in.path: not supported with 'engine'",
+			"source.commands.in.user: not supported with 'engine'",
+			"source.commands.in: missing required key 'script'",
+			"source.commands.out.script: script:1:8: got ':', want ')'",
+		}))
+	})
+})
+
+var _ = Describe("ValidateRequest hooks", func() {
+	It("accepts global and per action hooks", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"hooks": {
+					"pre": "echo pre",
+					"on_failure": { "path": "bash", "args": ["-c", "echo failed"] },
+					"in": { "post": "echo post" }
+				}
+			}
+		}`)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	It("reports unknown hooks and invalid commands", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"hooks": {
+					"pos": "echo post",
+					"check": { "pre": 1, "failure": "echo" }
+				}
+			}
+		}`)
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"source.hooks.check.failure: unknown key, expected one of: pre, post, on_failure",
+			"source.hooks.check.pre: expected string or {path,args}, got number",
+			"source.hooks.pos: unknown key, did you mean 'post'?",
+		}))
+	})
+})
+
+var _ = Describe("ValidateRequest wrap", func() {
+	It("reports invalid templates and unknown actions", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"wrap": {
+					"request_transform": "{{ .source ",
+					"response_transform": { "chek": "{{ json .response }}" }
+				}
+			}
+		}`)
+		problems := validationProblems(err)
+		Ω(problems).Should(HaveLen(3))
+		Ω(problems[0]).Should(Equal("source.wrap: missing required key 'path'"))
+		Ω(problems[1]).Should(HavePrefix("source.wrap.request_transform: invalid template: "))
+		Ω(problems[2]).Should(Equal("source.wrap.response_transform.chek: unknown key, did you mean 'check'?"))
+	})
+})
+
+var _ = Describe("ValidateRequest check_cache", func() {
+	It("reports a missing ttl and unknown keys", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"check_cache": { "dri": "/tmp/cache" }
+			}
+		}`)
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"source.check_cache: missing required key 'ttl'",
+			"source.check_cache.dri: unknown key, did you mean 'dir'?",
+		}))
+	})
+})
+
+var _ = Describe("ValidateRequest versions", func() {
+	It("reports invalid orders and filters", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"version_order": "by-size",
+				"version_filter": { "regex": "(", "semver": ">= one" }
+			}
+		}`)
+		problems := validationProblems(err)
+		Ω(problems).Should(HaveLen(3))
+		Ω(problems[0]).Should(HavePrefix("source.version_filter.regex: error parsing regexp"))
+		Ω(problems[1]).Should(HavePrefix("source.version_filter.semver: "))
+		Ω(problems[2]).Should(HavePrefix("source.version_order: invalid version_order 'by-size'"))
+	})
+})
+
+var _ = Describe("ValidateRequest command environment", func() {
+	It("reports invalid environments in commands and wrap", func() {
+		err := validateRequestJson(`{
+			"source": {
+				"commands": {
+					"in": { "path": "fetch", "umask": "999", "uid": "nobody", "env": { "A=B": "c", "D": 1 } }
+				},
+				"wrap": { "path": "/opt/resource/wrapped/git", "clear_env": "yes" }
+			}
+		}`)
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"source.commands.in.env: invalid variable name 'A=B'",
+			"source.commands.in.env.D: expected string, got number",
+			"source.commands.in.uid: expected integer, got string",
+			"source.commands.in.umask: invalid umask '999', expected octal mode like '022'",
+			"source.wrap.clear_env: expected boolean, got string",
+		}))
+	})
+})
+
+var _ = Describe("ValidateRequest environment names", func() {
+	It("reports invalid cases and prefixes", func() {
+		err := validateRequestJson(`{
+			"source": { "env_case": "camel", "env_prefix": 1, "env_flatten": true }
+		}`)
+		Ω(validationProblems(err)).Should(Equal([]string{
+			"source.env_case: invalid env_case 'camel', must be one of: preserve, upper, lower",
+			"source.env_prefix: expected string, got number",
+		}))
+	})
+})
+
+var _ = Describe("ParseInputAndConfig validation", func() {
+	It("masks the secrets in the errors", func() {
+		Ω(func() {
+			ParseInputAndConfig(CheckType, []byte(`{
+				"source": {
+					"secret_params": [ "mode" ],
+					"mode": "hunter2-mode",
+					"output_mode": "hunter2-mode"
+				}
+			}`), nil)
+		}).Should(PanicWith(And(
+			ContainSubstring("source.output_mode: invalid output_mode '***'"),
+			Not(ContainSubstring("hunter2")),
+		)))
+	})
+	It("warns about the params similar to smuggler keys", func() {
+		request = ParseInputAndConfig(CheckType, []byte(`{
+			"source": { "command": "echo", "commands": { "check": "echo" } }
+		}`), nil)
+		Ω(request.Source.ExtraParams).Should(HaveKeyWithValue("command", "echo"))
+		Ω(request.ValidationWarnings).Should(Equal([]string{
+			"source.command: passed as a parameter, but it is similar to the smuggler key 'commands'",
+		}))
+	})
+	It("validates the source merged with smuggler.yml", func() {
+		smugglerConfig, err := ParseSmugglerConfig([]byte(`
+version_store: { type: dir, dir: /tmp/versions }
+`), "smuggler.yml")
+		Ω(err).ShouldNot(HaveOccurred())
+		input := []byte(`{
+			"source": { "version_store": { "type": "s3", "bucket": "versions" } }
+		}`)
+		Ω(func() {
+			ParseInputAndConfig(CheckType, input, smugglerConfig)
+		}).Should(PanicWith(ContainSubstring(
+			"source.version_store.dir: unknown key, expected one of: access_key_id, bucket,",
+		)))
+	})
+})
@@ -0,0 +1,201 @@
+package smuggler
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// Where the versions put by out are stored, for check to report them
+type VersionStoreType string
+
+const (
+	// A JSON file in a local directory
+	VersionStoreDir VersionStoreType = "dir"
+	// A JSON object in a bucket of S3 or an S3 compatible service
+	VersionStoreS3 VersionStoreType = "s3"
+)
+
+var versionStoreTypes = []string{string(VersionStoreDir), string(VersionStoreS3)}
+
+// Stores the versions put by out, so check reports them when it has no
+// command
+type VersionStoreDefinition struct {
+	Type string `json:"type"`
+	// Name of the file or object of the versions. Default: a hash of the
+	// source without the smuggler configuration.
+	Key string `json:"key,omitempty"`
+	// Maximum number of versions to keep, the oldest are removed. Default:
+	// keep all of them.
+	MaxVersions int    `json:"max_versions,omitempty"`
+	Dir         string `json:"dir,omitempty"`
+	S3StoreDefinition
+}
+
+// The store of versions, oldest first
+type VersionStore interface {
+	Load() ([]Version, error)
+	// Saves the versions, or fails with errVersionStoreConflict if they
+	// changed since they were loaded
+	Save(versions []Version) error
+	// Releases the store
+	Close() error
+}
+
+// The versions were changed by another put since they were loaded
+var errVersionStoreConflict = errors.New("the versions changed since they were read")
+
+// Times to try to store a version if other puts change the versions
+const versionStoreAttempts = 10
+
+// Opens the store of the request. The dir store is locked until it is
+// closed, the s3 one is only written if the versions did not change since
+// they were loaded.
+func openVersionStore(request *ResourceRequest) (VersionStore, error) {
+	definition := request.Source.VersionStore
+	key := definition.Key
+	if key == "" {
+		b, err := json.Marshal(request.FilteredRequest.Source)
+		if err != nil {
+			return nil, err
+		}
+		key = fmt.Sprintf("smuggler-versions-%x", sha256.Sum256(b))
+	}
+	switch VersionStoreType(definition.Type) {
+	case VersionStoreDir:
+		return openDirVersionStore(definition.Dir, key)
+	case VersionStoreS3:
+		return newS3VersionStore(definition.S3StoreDefinition, key), nil
+	default:
+		return nil, fmt.Errorf("invalid version_store.type '%s', must be one of: %s, %s", definition.Type, VersionStoreDir, VersionStoreS3)
+	}
+}
+
+// Returns the versions to report by check: the ones from the version of
+// the request, or only the latest one if the store does not have it
+func checkStoredVersions(current Version, stored []Version) []Version {
+	if len(stored) == 0 {
+		return []Version{}
+	}
+	for i, v := range stored {
+		if len(current) > 0 && reflect.DeepEqual(v, current) {
+			return stored[i:]
+		}
+	}
+	return stored[len(stored)-1:]
+}
+
+// Adds the version as the latest one, removing it if it was already stored
+// and the oldest ones over max_versions
+func (definition VersionStoreDefinition) addVersion(stored []Version, version Version) []Version {
+	versions := make([]Version, 0, len(stored)+1)
+	for _, v := range stored {
+		if !reflect.DeepEqual(v, version) {
+			versions = append(versions, v)
+		}
+	}
+	versions = append(versions, version)
+	if definition.MaxVersions > 0 && len(versions) > definition.MaxVersions {
+		versions = versions[len(versions)-definition.MaxVersions:]
+	}
+	return versions
+}
+
+// Reports the stored versions, for check without a command
+func (command *SmugglerCommand) checkVersionStore(request *ResourceRequest, response *ResourceResponse) error {
+	store, err := openVersionStore(request)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	stored, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("reading the version store: %s", err)
+	}
+	response.Versions = checkStoredVersions(request.Version, stored)
+	return nil
+}
+
+// Stores the version put by out
+func (command *SmugglerCommand) putVersionStore(request *ResourceRequest, response *ResourceResponse) error {
+	if len(response.Version) == 0 {
+		command.logger.Printf("[WARN] out did not report any version, nothing to store")
+		return nil
+	}
+	store, err := openVersionStore(request)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	for attempt := 1; ; attempt++ {
+		stored, err := store.Load()
+		if err != nil {
+			return fmt.Errorf("reading the version store: %s", err)
+		}
+		versions := request.Source.VersionStore.addVersion(stored, response.Version)
+		err = store.Save(versions)
+		if err == errVersionStoreConflict && attempt < versionStoreAttempts {
+			command.logger.Printf("[INFO] Version store changed by another put, retrying (%d/%d)", attempt, versionStoreAttempts)
+			time.Sleep(time.Duration(rand.Intn(100*attempt)) * time.Millisecond)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("writing the version store: %s", err)
+		}
+		command.logger.Printf("[INFO] Stored version '%q', %d versions in the store", response.Version, len(versions))
+		return nil
+	}
+}
+
+// Versions in a JSON file, locked while the store is open
+type dirVersionStore struct {
+	path string
+	lock *os.File
+}
+
+func openDirVersionStore(dir string, key string) (*dirVersionStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, key)
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("locking '%s': %s", lock.Name(), err)
+	}
+	return &dirVersionStore{path: path + ".json", lock: lock}, nil
+}
+
+func (store *dirVersionStore) Load() ([]Version, error) {
+	versions := []Version{}
+	if _, err := os.Stat(store.path); os.IsNotExist(err) {
+		return versions, nil
+	}
+	if err := readJsonFile(store.path, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (store *dirVersionStore) Save(versions []Version) error {
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(store.path, b, 0600)
+}
+
+func (store *dirVersionStore) Close() error {
+	syscall.Flock(int(store.lock.Fd()), syscall.LOCK_UN)
+	return store.lock.Close()
+}
@@ -0,0 +1,237 @@
+package smuggler
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bucket of the s3 version store. The credentials are taken from the
+// environment, as in the AWS CLI, if they are not given.
+type S3StoreDefinition struct {
+	Bucket string `json:"bucket,omitempty"`
+	// URL of an S3 compatible service, like `https://minio.example.com`.
+	// The bucket is in the path. Default: the AWS S3 endpoint of the region,
+	// with the bucket in the host.
+	Endpoint        string `json:"endpoint,omitempty"`
+	Region          string `json:"region,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+}
+
+const DefaultS3Region = "us-east-1"
+
+type s3VersionStore struct {
+	definition S3StoreDefinition
+	key        string
+	client     *http.Client
+	// ETag of the object when it was loaded, empty if it did not exist
+	etag string
+}
+
+func newS3VersionStore(definition S3StoreDefinition, key string) *s3VersionStore {
+	if definition.Region == "" {
+		definition.Region = firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), DefaultS3Region)
+	}
+	if definition.AccessKeyID == "" {
+		definition.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		definition.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		definition.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	return &s3VersionStore{
+		definition: definition,
+		key:        key + ".json",
+		client:     &http.Client{Timeout: 1 * time.Minute},
+	}
+}
+
+func (store *s3VersionStore) url() string {
+	path := "/" + s3EscapePath(store.key)
+	if store.definition.Endpoint != "" {
+		return strings.TrimRight(store.definition.Endpoint, "/") + "/" + s3EscapePath(store.definition.Bucket) + path
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", store.definition.Bucket, store.definition.Region, path)
+}
+
+func (store *s3VersionStore) Load() ([]Version, error) {
+	resp, body, err := store.do("GET", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	versions := []Version{}
+	store.etag = ""
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return versions, nil
+	case http.StatusForbidden:
+		// S3 does not tell a missing object from a forbidden one without
+		// s3:ListBucket, so it cannot be taken as an empty store
+		return nil, fmt.Errorf(
+			"GET '%s': %s: %s (a missing object is also forbidden without the s3:ListBucket permission)",
+			store.url(), resp.Status, body,
+		)
+	default:
+		return nil, fmt.Errorf("GET '%s': %s: %s", store.url(), resp.Status, body)
+	}
+	if err := json.Unmarshal(body, &versions); err != nil {
+		return nil, fmt.Errorf("parsing '%s': %s", store.url(), err)
+	}
+	store.etag = resp.Header.Get("ETag")
+	return versions, nil
+}
+
+// Writes the versions only if the object did not change since it was
+// loaded, or it still does not exist. Services which ignore If-Match and
+// If-None-Match always write, losing the concurrent puts.
+func (store *s3VersionStore) Save(versions []Version) error {
+	b, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"If-None-Match": "*"}
+	if store.etag != "" {
+		headers = map[string]string{"If-Match": store.etag}
+	}
+	resp, body, err := store.do("PUT", b, headers)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		store.etag = resp.Header.Get("ETag")
+		return nil
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// S3 replies 409 if another conditional write is in progress
+		return errVersionStoreConflict
+	default:
+		return fmt.Errorf("PUT '%s': %s: %s", store.url(), resp.Status, body)
+	}
+}
+
+func (store *s3VersionStore) Close() error {
+	return nil
+}
+
+func (store *s3VersionStore) do(method string, content []byte, headers map[string]string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, store.url(), bytes.NewReader(content))
+	if err != nil {
+		return nil, nil, err
+	}
+	if content != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	signS3Request(req, content, store.definition, time.Now().UTC())
+	resp, err := store.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+// Signs the request with AWS Signature Version 4, if there are credentials
+func signS3Request(req *http.Request, content []byte, definition S3StoreDefinition, now time.Time) {
+	if definition.AccessKeyID == "" {
+		return
+	}
+	payloadHash := sha256Hex(content)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if definition.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", definition.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders += k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, definition.Region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + definition.SecretAccessKey)
+	for _, s := range []string{date, definition.Region, "s3", "aws4_request"} {
+		key = hmacSha256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		definition.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+// Escapes each segment of the path as S3 expects, all but the unreserved
+// characters
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, s string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
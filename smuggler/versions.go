@@ -0,0 +1,247 @@
+package smuggler
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+// How the versions reported by check are ordered
+type VersionOrderKind string
+
+const (
+	// As reported by the command
+	VersionOrderAsIs VersionOrderKind = "as-is"
+	// By the ID as semantic versions
+	VersionOrderSemver VersionOrderKind = "semver"
+	// By the ID as numbers
+	VersionOrderNumeric VersionOrderKind = "numeric"
+	// By the ID as strings
+	VersionOrderLexical VersionOrderKind = "lexical"
+	// By the value of the given key, as semantic versions or numbers if
+	// possible, or as strings
+	VersionOrderByKey VersionOrderKind = "by-key"
+)
+
+type VersionOrder struct {
+	Kind VersionOrderKind
+	Key  string
+}
+
+func NewVersionOrder(s string) (VersionOrder, error) {
+	switch k := VersionOrderKind(s); k {
+	case "", VersionOrderAsIs:
+		return VersionOrder{Kind: VersionOrderAsIs}, nil
+	case VersionOrderSemver, VersionOrderNumeric, VersionOrderLexical:
+		return VersionOrder{Kind: k, Key: "ID"}, nil
+	}
+	if strings.HasPrefix(s, string(VersionOrderByKey)+":") {
+		key := strings.TrimPrefix(s, string(VersionOrderByKey)+":")
+		if key == "" {
+			return VersionOrder{}, fmt.Errorf("invalid version_order '%s', missing the key", s)
+		}
+		return VersionOrder{Kind: VersionOrderByKey, Key: key}, nil
+	}
+	return VersionOrder{}, fmt.Errorf(
+		"invalid version_order '%s', must be one of: %s, %s, %s, %s, %s:<key>",
+		s, VersionOrderAsIs, VersionOrderSemver, VersionOrderNumeric, VersionOrderLexical, VersionOrderByKey,
+	)
+}
+
+// Value of the version to sort it, or an error if it cannot be compared
+// with this order
+func (order VersionOrder) sortValue(v Version) (interface{}, error) {
+	s, ok := v[order.Key]
+	if !ok {
+		return nil, fmt.Errorf("missing key '%s'", order.Key)
+	}
+	switch order.Kind {
+	case VersionOrderSemver:
+		return semver.NewVersion(s)
+	case VersionOrderNumeric:
+		return strconv.ParseFloat(s, 64)
+	case VersionOrderByKey:
+		if sv, err := semver.NewVersion(s); err == nil {
+			return sv, nil
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f, nil
+		}
+	}
+	return s, nil
+}
+
+// Compares two sort values, semantic versions before numbers and numbers
+// before strings if they are mixed
+func compareSortValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case *semver.Version:
+		if b, ok := b.(*semver.Version); ok {
+			return a.Compare(b)
+		}
+		return -1
+	case float64:
+		switch b := b.(type) {
+		case *semver.Version:
+			return 1
+		case float64:
+			switch {
+			case a < b:
+				return -1
+			case a > b:
+				return 1
+			}
+			return 0
+		}
+		return -1
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+		return 1
+	}
+	return 0
+}
+
+// Only the versions matching the filter are reported by check
+type VersionFilter struct {
+	Regex  string `json:"regex,omitempty"`
+	Semver string `json:"semver,omitempty"`
+	// Key of the version to filter by, `ID` by default
+	Key string `json:"key,omitempty"`
+}
+
+// Returns the filter function, or an error if the filter is invalid
+func (filter VersionFilter) matcher() (func(Version) bool, error) {
+	key := filter.Key
+	if key == "" {
+		key = "ID"
+	}
+	var regex *regexp.Regexp
+	var constraint *semver.Constraints
+	var err error
+	if filter.Regex != "" {
+		if regex, err = regexp.Compile(filter.Regex); err != nil {
+			return nil, fmt.Errorf("invalid version_filter.regex '%s': %s", filter.Regex, err)
+		}
+	}
+	if filter.Semver != "" {
+		if constraint, err = semver.NewConstraint(filter.Semver); err != nil {
+			return nil, fmt.Errorf("invalid version_filter.semver '%s': %s", filter.Semver, err)
+		}
+	}
+	return func(v Version) bool {
+		s, ok := v[key]
+		if !ok {
+			return false
+		}
+		if regex != nil && !regex.MatchString(s) {
+			return false
+		}
+		if constraint != nil {
+			sv, err := semver.NewVersion(s)
+			if err != nil || !constraint.Check(sv) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// Canonical form of the version to compare it, as JSON with sorted keys
+func versionKey(v Version) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// Removes the repeated versions, keeping the first one
+func dedupVersions(versions []Version) []Version {
+	result := make([]Version, 0, len(versions))
+	seen := make(map[string]bool, len(versions))
+	for _, v := range versions {
+		key := versionKey(v)
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Deduplicates, filters and sorts the versions reported by check, and trims
+// them to start at the current version as concourse expects. If they are
+// sorted, they start at the latest one if there is no current version. As
+// they are reported, they start at the current version only if it is
+// there. Returns the versions and the ones discarded because they cannot be
+// sorted.
+func (source SmugglerSource) ProcessVersions(current Version, versions []Version) ([]Version, []Version, error) {
+	versions = dedupVersions(versions)
+
+	if source.VersionFilter != nil {
+		match, err := source.VersionFilter.matcher()
+		if err != nil {
+			return nil, nil, err
+		}
+		filtered := make([]Version, 0, len(versions))
+		for _, v := range versions {
+			if match(v) {
+				filtered = append(filtered, v)
+			}
+		}
+		versions = filtered
+	}
+
+	order, err := NewVersionOrder(source.VersionOrder)
+	if err != nil {
+		return nil, nil, err
+	}
+	if order.Kind == VersionOrderAsIs {
+		if len(current) > 0 {
+			currentKey := versionKey(current)
+			for i, v := range versions {
+				if versionKey(v) == currentKey {
+					return versions[i:], nil, nil
+				}
+			}
+		}
+		return versions, nil, nil
+	}
+
+	type sortable struct {
+		version Version
+		value   interface{}
+	}
+	sorted := make([]sortable, 0, len(versions))
+	discarded := []Version{}
+	for _, v := range versions {
+		value, err := order.sortValue(v)
+		if err != nil {
+			discarded = append(discarded, v)
+			continue
+		}
+		sorted = append(sorted, sortable{v, value})
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return compareSortValues(sorted[i].value, sorted[j].value) < 0
+	})
+
+	start := len(sorted) - 1
+	if currentValue, err := order.sortValue(current); err == nil && len(current) > 0 {
+		for i, s := range sorted {
+			if compareSortValues(s.value, currentValue) >= 0 {
+				start = i
+				break
+			}
+		}
+	}
+	result := make([]Version, 0, len(sorted))
+	for i := start; i >= 0 && i < len(sorted); i++ {
+		result = append(result, sorted[i].version)
+	}
+	return result, discarded, nil
+}
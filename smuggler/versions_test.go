@@ -0,0 +1,123 @@
+package smuggler_test
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/redfactorlabs/concourse-smuggler-resource/smuggler"
+)
+
+func versionIds(versions []Version) []string {
+	ids := make([]string, 0, len(versions))
+	for _, v := range versions {
+		ids = append(ids, v.ToString())
+	}
+	return ids
+}
+
+var _ = Describe("ProcessVersions", func() {
+	processVersions := func(source SmugglerSource, current string, versions []string) []string {
+		var currentVersion Version
+		if current != "" {
+			currentVersion = *NewVersion(current)
+		}
+		result, _, err := source.ProcessVersions(currentVersion, NewVersions(versions))
+		Ω(err).ShouldNot(HaveOccurred())
+		return versionIds(result)
+	}
+
+	It("keeps the order as-is, only removing duplicates", func() {
+		Ω(processVersions(
+			SmugglerSource{}, "1.0.0",
+			[]string{"b", "a", "b", "c"},
+		)).Should(Equal([]string{"b", "a", "c"}))
+	})
+
+	It("keeps the order as-is, starting at the current version", func() {
+		Ω(processVersions(
+			SmugglerSource{}, "a",
+			[]string{"b", "a", "b", "c"},
+		)).Should(Equal([]string{"a", "c"}))
+	})
+
+	It("dedups many versions", func() {
+		versions := make([]string, 0, 20000)
+		for i := 0; i < 20000; i++ {
+			versions = append(versions, fmt.Sprintf("%d", i%10000))
+		}
+		Ω(processVersions(SmugglerSource{}, "9998", versions)).Should(Equal([]string{"9998", "9999"}))
+	})
+
+	It("sorts by semver starting at the current version", func() {
+		Ω(processVersions(
+			SmugglerSource{VersionOrder: "semver"}, "1.2.0",
+			[]string{"1.10.0", "1.2.0", "1.9.0", "1.1.0", "v1.10.0", "1.10.0"},
+		)).Should(Equal([]string{"1.2.0", "1.9.0", "1.10.0", "v1.10.0"}))
+	})
+
+	It("returns the newer versions if the current one is gone", func() {
+		Ω(processVersions(
+			SmugglerSource{VersionOrder: "numeric"}, "5",
+			[]string{"10", "2", "7", "4"},
+		)).Should(Equal([]string{"7", "10"}))
+	})
+
+	It("returns the latest version if there is no current version", func() {
+		Ω(processVersions(
+			SmugglerSource{VersionOrder: "lexical"}, "",
+			[]string{"b", "c", "a"},
+		)).Should(Equal([]string{"c"}))
+	})
+
+	It("returns the latest version if there is none newer than the current one", func() {
+		Ω(processVersions(
+			SmugglerSource{VersionOrder: "semver"}, "3.0.0",
+			[]string{"1.0.0", "2.0.0"},
+		)).Should(Equal([]string{"2.0.0"}))
+	})
+
+	It("filters by regex", func() {
+		Ω(processVersions(
+			SmugglerSource{VersionFilter: &VersionFilter{Regex: "^release-"}}, "",
+			[]string{"release-1", "dev-2", "release-3"},
+		)).Should(Equal([]string{"release-1", "release-3"}))
+	})
+
+	It("filters by semver constraint and sorts", func() {
+		Ω(processVersions(
+			SmugglerSource{VersionOrder: "semver", VersionFilter: &VersionFilter{Semver: ">= 1.2, < 2"}}, "1.0.0",
+			[]string{"2.0.0", "1.3.0", "1.0.0", "1.2.0", "not-a-version"},
+		)).Should(Equal([]string{"1.2.0", "1.3.0"}))
+	})
+
+	It("sorts and filters by the given key", func() {
+		source := SmugglerSource{
+			VersionOrder:  "by-key:timestamp",
+			VersionFilter: &VersionFilter{Key: "branch", Regex: "^main$"},
+		}
+		versions := []Version{
+			{"ref": "c", "branch": "main", "timestamp": "30"},
+			{"ref": "a", "branch": "main", "timestamp": "10"},
+			{"ref": "b", "branch": "dev", "timestamp": "20"},
+			{"ref": "d", "branch": "main", "timestamp": "40"},
+		}
+		result, _, err := source.ProcessVersions(Version{"ref": "c", "timestamp": "30"}, versions)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(result).Should(Equal([]Version{versions[0], versions[3]}))
+	})
+
+	It("discards the versions which cannot be sorted", func() {
+		source := SmugglerSource{VersionOrder: "semver"}
+		result, discarded, err := source.ProcessVersions(nil, NewVersions([]string{"1.0.0", "latest"}))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(versionIds(result)).Should(Equal([]string{"1.0.0"}))
+		Ω(versionIds(discarded)).Should(Equal([]string{"latest"}))
+	})
+
+	It("fails with an invalid order", func() {
+		_, _, err := SmugglerSource{VersionOrder: "by-key:"}.ProcessVersions(nil, nil)
+		Ω(err).Should(MatchError(ContainSubstring("missing the key")))
+	})
+})
@@ -0,0 +1,173 @@
+package smuggler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Resource wrapped by smuggler, which is called for the actions without
+// a command defined. Its request and response can be transformed with
+// templates.
+type WrapDefinition struct {
+	// Directory with the check, in and out commands of the wrapped resource
+	Path              string          `json:"path"`
+	RequestTransform  ActionTemplates `json:"request_transform,omitempty"`
+	ResponseTransform ActionTemplates `json:"response_transform,omitempty"`
+	// Environment of the commands of the wrapped resource
+	CommandEnvironment
+}
+
+// Templates by action, which can be given as a single template for all
+// of them, or as a map by action name.
+type ActionTemplates map[RequestType]string
+
+func (t *ActionTemplates) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = ActionTemplates{CheckType: s, InType: s, OutType: s}
+		return nil
+	}
+	var m map[RequestType]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("expected a template or a map of templates by action: %s", err)
+	}
+	*t = ActionTemplates(m)
+	return nil
+}
+
+// Returns the definition of the command of the wrapped resource for the
+// given action, which inherits the global timeouts.
+func (source SmugglerSource) WrappedCommand(action RequestType, dataDir string) *CommandDefinition {
+	if source.Wrap == nil {
+		return nil
+	}
+	c := &CommandDefinition{
+		Path:               filepath.Join(source.Wrap.Path, string(action)),
+		Timeout:            source.Timeout,
+		GracePeriod:        source.GracePeriod,
+		CommandEnvironment: source.Wrap.CommandEnvironment,
+	}
+	if action != CheckType {
+		c.Args = []string{dataDir}
+	}
+	return c
+}
+
+// Calls the wrapped resource with the request without the smuggler
+// configuration, applying the transforms to the request and the response.
+func (command *SmugglerCommand) runWrappedAttempt(commandDefinition CommandDefinition, dataDir string, request *ResourceRequest, response *ResourceResponse) error {
+	wrap := request.Source.Wrap
+
+	outputDir, err := ioutil.TempDir("", "smuggler-run")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(outputDir)
+
+	params, err := prepareParams(dataDir, outputDir, request)
+	if err != nil {
+		return err
+	}
+
+	jsonRequest, err := json.Marshal(request.FilteredRequest)
+	if err != nil {
+		return err
+	}
+	if t, ok := wrap.RequestTransform[request.Type]; ok {
+		var filteredRequest interface{}
+		if err := json.Unmarshal(jsonRequest, &filteredRequest); err != nil {
+			return err
+		}
+		data := map[string]interface{}{
+			"action": string(request.Type),
+			"dir":    dataDir,
+		}
+		for k, v := range filteredRequest.(map[string]interface{}) {
+			data[k] = v
+		}
+		jsonRequest, err = applyJsonTransform("request_transform", t, data)
+		if err != nil {
+			return err
+		}
+		command.logger.Printf("[INFO] Transformed request: %s", jsonRequest)
+	}
+
+	err = command.Run(commandDefinition, params, jsonRequest)
+	if err != nil {
+		return err
+	}
+
+	output := command.LastCommandOutput
+	if t, ok := wrap.ResponseTransform[request.Type]; ok {
+		var requestData, responseData interface{}
+		if err := json.Unmarshal(jsonRequest, &requestData); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(output, &responseData); err != nil {
+			return fmt.Errorf("wrapped resource: invalid JSON response: %s", err)
+		}
+		output, err = applyJsonTransform("response_transform", t, map[string]interface{}{
+			"action":   string(request.Type),
+			"request":  requestData,
+			"response": responseData,
+		})
+		if err != nil {
+			return err
+		}
+		command.logger.Printf("[INFO] Transformed response: %s", output)
+	}
+
+	if err := decodeResourceResponse(output, response); err != nil {
+		return fmt.Errorf("wrapped resource: %s", err)
+	}
+	// Empty the output buffer
+	command.LastCommandOutput = []byte{}
+	useDefaultVersion(request, response)
+	return nil
+}
+
+// Renders the template, which must result in valid JSON
+func applyJsonTransform(name string, text string, data interface{}) ([]byte, error) {
+	b, err := renderTemplate(name, text, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	if !json.Valid(b) {
+		return nil, fmt.Errorf("%s: result is not valid JSON: %s", name, b)
+	}
+	return b, nil
+}
+
+// Decodes a response of the given type, as concourse expects it: a list
+// of versions for check, or the version and metadata for in and out.
+func decodeResourceResponse(b []byte, response *ResourceResponse) error {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+
+	if response.Type == CheckType {
+		var versions []Version
+		if err := decoder.Decode(&versions); err != nil {
+			return fmt.Errorf("invalid response, expected a list of versions: %s", err)
+		}
+		response.Versions = versions
+		return nil
+	}
+
+	var r struct {
+		Version  Version        `json:"version"`
+		Metadata []MetadataPair `json:"metadata"`
+	}
+	if err := decoder.Decode(&r); err != nil {
+		return fmt.Errorf("invalid response, expected {version,metadata}: %s", err)
+	}
+	if len(r.Version) == 0 {
+		return fmt.Errorf("invalid response, missing version")
+	}
+	response.Version = r.Version
+	response.Metadata = r.Metadata
+	return nil
+}
@@ -153,6 +153,19 @@ var _ = Describe("smuggler commands", func() {
 		})
 	})
 
+	Context("when given a default_check_version and no command", func() {
+		BeforeEach(func() {
+			commandPath, jsonRequest = prepareCommandCheck("default_versions")
+		})
+
+		It("returns the default version", func() {
+			var response []Version
+			err := json.Unmarshal(session.Out.Contents(), &response)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response).Should(Equal([]Version{{"ID": "static"}}))
+		})
+	})
+
 	Context("when given a command which fails", func() {
 		Context("for the 'check' command", func() {
 			BeforeEach(func() {
@@ -186,6 +199,54 @@ var _ = Describe("smuggler commands", func() {
 		})
 	})
 
+	Context("when given a command which times out", func() {
+		BeforeEach(func() {
+			expectedExitStatus = TimeoutExitStatus
+			commandPath, jsonRequest = prepareCommandCheck("timeout_command")
+		})
+
+		It("returns a timeout error", func() {
+			Ω(session.Err).Should(gbytes.Say("error running command: command timed out after 1s"))
+		})
+	})
+
+	Context("when given an invalid configuration", func() {
+		BeforeEach(func() {
+			expectedExitStatus = 1
+			commandPath, jsonRequest = prepareCommandCheck("invalid_config")
+		})
+
+		It("reports all the problems with their path", func() {
+			stderr := session.Err.Contents()
+			Ω(stderr).Should(ContainSubstring("source.comands: unknown smuggler key, did you mean 'commands'?"))
+			Ω(stderr).Should(ContainSubstring("source.hooks.pre: expected string or {path,args}, got list"))
+		})
+	})
+
+	Context("when given params which do not match the params_schema", func() {
+		BeforeEach(func() {
+			expectedExitStatus = 1
+			commandPath, dataDir, jsonRequest = prepareCommandOut("params_schema")
+		})
+
+		It("reports the invalid params", func() {
+			Ω(session.Err).Should(gbytes.Say("invalid parameters:"))
+			Ω(session.Err).Should(gbytes.Say("bucket: required parameter for 'out' is missing"))
+		})
+	})
+
+	Context("when a sensitive param is invalid", func() {
+		BeforeEach(func() {
+			expectedExitStatus = 1
+			commandPath, jsonRequest = prepareCommandCheck("sensitive_params_schema")
+		})
+
+		It("does not leak its value in the error", func() {
+			Ω(session.Err).Should(gbytes.Say(`pin: invalid value \*\*\*, must be one of`))
+			Ω(string(session.Err.Contents())).ShouldNot(ContainSubstring("4242-secret-pin"))
+		})
+	})
+
 	Context("when there is local config file 'smuggler.yml' that is empty", func() {
 		BeforeEach(func() {
 			configPath = "./fixtures/empty_smuggler.yml"
@@ -315,6 +376,56 @@ var _ = Describe("smuggler commands", func() {
 
 	})
 
+	Context("when there are several config files in SMUGGLER_CONFIG", func() {
+		BeforeEach(func() {
+			configPath = "./fixtures/full_smuggler.yml:./fixtures/override_smuggler.yml"
+			commandPath, jsonRequest = prepareCommandCheck("dummy_command")
+		})
+
+		It("merges them in order", func() {
+			stderr := session.Err.Contents()
+			Ω(stderr).Should(ContainSubstring("from config file"))
+			Ω(stderr).Should(ContainSubstring("config_param1=param_in_override"))
+		})
+	})
+
+	Context("when running a command with output_mode both-prefix", func() {
+		BeforeEach(func() {
+			commandPath, jsonRequest = prepareCommandCheck("output_mode_prefix")
+		})
+		It("prints the output of the command prefixed by stream to stderr", func() {
+			stderr := session.Err.Contents()
+			Ω(stderr).Should(ContainSubstring("stdout: to stdout\n"))
+			Ω(stderr).Should(ContainSubstring("stderr: to stderr\n"))
+		})
+		It("keeps stdout for the response", func() {
+			var response []Version
+			err := json.Unmarshal(session.Out.Contents(), &response)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response).Should(BeEquivalentTo(NewVersions([]string{"1.2.3"})))
+		})
+	})
+
+	Context("when running a command with secret params in debug", func() {
+		BeforeEach(func() {
+			commandPath, jsonRequest = prepareCommandCheck("secret_params")
+		})
+		It("masks the secrets in the output", func() {
+			stderr := session.Err.Contents()
+			Ω(stderr).Should(ContainSubstring("user=***"))
+			Ω(stderr).Should(ContainSubstring("password=***"))
+			Ω(stderr).ShouldNot(ContainSubstring("admin-user"))
+			Ω(stderr).ShouldNot(ContainSubstring("hunter22"))
+		})
+		It("masks the secrets in the log", func() {
+			log, err := ioutil.ReadFile(logFile.Name())
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(log).Should(ContainSubstring("Smuggler command called as"))
+			Ω(log).ShouldNot(ContainSubstring("admin-user"))
+			Ω(log).ShouldNot(ContainSubstring("hunter22"))
+		})
+	})
+
 	Context("when running a quiet command", func() {
 		Context("when running 'check'", func() {
 			BeforeEach(func() {
@@ -409,3 +520,173 @@ func InOutCommonSmugglerTests(session **gexec.Session) func() {
 		})
 	}
 }
+
+var _ = Describe("smuggler inject", func() {
+	var rootfs string
+
+	BeforeEach(func() {
+		rootfs, err = ioutil.TempDir("", "rootfs")
+		Ω(err).ShouldNot(HaveOccurred())
+		os.MkdirAll(filepath.Join(rootfs, "opt", "resource"), 0755)
+		err = ioutil.WriteFile(filepath.Join(rootfs, "opt", "resource", "check"), []byte("original check"), 0755)
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		os.RemoveAll(rootfs)
+	})
+
+	It("injects itself in the rootfs with the given config", func() {
+		smugglerPath := filepath.Join(filepath.Dir(checkPath), "concourse-smuggler-resource")
+		command := exec.Command(smugglerPath, "inject", "-name", "s3", rootfs, "example-smuggler.yml")
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+
+		injected, err := ioutil.ReadFile(filepath.Join(rootfs, "opt", "resource", "check"))
+		Ω(err).ShouldNot(HaveOccurred())
+		original, err := ioutil.ReadFile(smugglerPath)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(injected).Should(Equal(original))
+
+		wrapped, err := ioutil.ReadFile(filepath.Join(rootfs, "opt", "resource", "wrapped", "s3", "check"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(string(wrapped)).Should(Equal("original check"))
+		Ω(filepath.Join(rootfs, "opt", "resource", "smuggler.yml")).Should(BeARegularFile())
+	})
+
+	It("fails with an invalid config", func() {
+		smugglerPath := filepath.Join(filepath.Dir(checkPath), "concourse-smuggler-resource")
+		configPath := filepath.Join(rootfs, "smuggler.yml")
+		err = ioutil.WriteFile(configPath, []byte("output_mode: everything\n"), 0644)
+		Ω(err).ShouldNot(HaveOccurred())
+		command := exec.Command(smugglerPath, "inject", rootfs, configPath)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(1))
+		Ω(session.Err).Should(gbytes.Say("error inject: invalid configuration"))
+	})
+})
+
+var _ = Describe("smuggler run", func() {
+	var (
+		session    *gexec.Session
+		args       []string
+		destDir    string
+		exitStatus int
+	)
+
+	BeforeEach(func() {
+		destDir, err = ioutil.TempDir("", "destination")
+		Ω(err).ShouldNot(HaveOccurred())
+		exitStatus = 0
+	})
+	AfterEach(func() {
+		os.RemoveAll(destDir)
+	})
+	JustBeforeEach(func() {
+		smugglerPath := filepath.Join(filepath.Dir(checkPath), "concourse-smuggler-resource")
+		command := exec.Command(smugglerPath, append([]string{"run", "-pipeline", "fixtures/pipeline.yml"}, args...)...)
+		command.Env = append(os.Environ(),
+			fmt.Sprintf("SMUGGLER_LOG=%s", filepath.Join(destDir, "smuggler.log")),
+			"SMUGGLER_CONFIG=",
+		)
+		session, err = gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(exitStatus))
+	})
+
+	Context("when running in with the params of a job", func() {
+		BeforeEach(func() {
+			args = []string{"-resource", "complex_command", "-job", "a_job", "-action", "in", "-version", "1.2.3", filepath.Join(destDir, "in")}
+		})
+		It("prints the response", func() {
+			var response ResourceResponse
+			err := json.Unmarshal(session.Out.Contents(), &response)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(response.Version).Should(Equal(*NewVersion("1.2.3")))
+		})
+		It("runs the command with the params of the step", func() {
+			Ω(session.Err).Should(gbytes.Say("param4=val4"))
+		})
+	})
+
+	Context("when the resource does not exist", func() {
+		BeforeEach(func() {
+			args = []string{"-resource", "missing"}
+			exitStatus = 1
+		})
+		It("fails", func() {
+			Ω(session.Err).Should(gbytes.Say("Cannot find a resource called 'missing'"))
+		})
+	})
+})
+
+var _ = Describe("smuggler replay", func() {
+	var tmpDir, replayDir, bundlePath string
+
+	BeforeEach(func() {
+		tmpDir, err = ioutil.TempDir("", "replay")
+		Ω(err).ShouldNot(HaveOccurred())
+		replayDir = filepath.Join(tmpDir, "replays")
+
+		// The command is defined in smuggler.yml and uses the environment
+		configPath := filepath.Join(tmpDir, "smuggler.yml")
+		config := "commands:\n  check: echo \"${REPLAY_TEST_VERSION}\" > ${SMUGGLER_OUTPUT_DIR}/versions\n"
+		Ω(ioutil.WriteFile(configPath, []byte(config), 0644)).Should(Succeed())
+
+		command := exec.Command(checkPath)
+		command.Stdin = bytes.NewBufferString(`{"source": {}}`)
+		command.Env = append(os.Environ(),
+			fmt.Sprintf("SMUGGLER_LOG=%s", filepath.Join(tmpDir, "smuggler.log")),
+			fmt.Sprintf("SMUGGLER_CONFIG=%s", configPath),
+			fmt.Sprintf("SMUGGLER_REPLAY_DIR=%s", replayDir),
+			"REPLAY_TEST_VERSION=1.2.3",
+		)
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+
+		bundles, err := filepath.Glob(filepath.Join(replayDir, "*-check-*.json"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(bundles).Should(HaveLen(1))
+		bundlePath = bundles[0]
+		// Nothing of the original run is needed to replay it
+		os.Remove(configPath)
+	})
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	replay := func(args ...string) *gexec.Session {
+		smugglerPath := filepath.Join(filepath.Dir(checkPath), "concourse-smuggler-resource")
+		command := exec.Command(smugglerPath, append(append([]string{"replay"}, args...), bundlePath)...)
+		command.Env = []string{}
+		session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+		Ω(err).ShouldNot(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+		return session
+	}
+
+	It("writes the bundle with the response and the environment of the command", func() {
+		bundle, err := ReadReplayBundle(bundlePath)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(bundle.Response.Versions).Should(Equal([]Version{*NewVersion("1.2.3")}))
+		Ω(bundle.Env).Should(ContainElement("REPLAY_TEST_VERSION=1.2.3"))
+		Ω(bundle.CommandEnv).Should(ContainElement("SMUGGLER_COMMAND=check"))
+		Ω(bundle.CommandEnv).Should(ContainElement("REPLAY_TEST_VERSION=1.2.3"))
+	})
+
+	It("replays the action with the config and the environment", func() {
+		session := replay()
+		Ω(session.Out.Contents()).Should(MatchJSON(`[{"ID": "1.2.3"}]`))
+		// The replay does not write another bundle
+		bundles, err := filepath.Glob(filepath.Join(replayDir, "*.json"))
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(bundles).Should(Equal([]string{bundlePath}))
+	})
+
+	It("replays the action with another command", func() {
+		session := replay("-command", `echo "4.5.6" > ${SMUGGLER_OUTPUT_DIR}/versions`)
+		Ω(session.Out.Contents()).Should(MatchJSON(`[{"ID": "4.5.6"}]`))
+	})
+})